@@ -0,0 +1,22 @@
+-- ジャッジが読み書きするようになったカラム (MySQL)。
+-- テーブルは cafecoder のウェブアプリ側のものなので、そちらのマイグレーションにも同じものを入れること。
+-- NULL を読むと gorm で string や int に入れられないので、ジャッジが読むカラムはすべて NOT NULL にする
+
+ALTER TABLE problems
+  ADD COLUMN execution_time_limit INT NOT NULL DEFAULT 0 COMMENT '実行時間制限 (ms)。0 なら既定値',
+  ADD COLUMN memory_limit INT NOT NULL DEFAULT 0 COMMENT 'メモリ制限 (MiB)。0 なら既定値',
+  ADD COLUMN checker VARCHAR(32) NOT NULL DEFAULT '' COMMENT 'チェッカーの種類。空なら whitespace',
+  ADD COLUMN absolute_error DOUBLE NOT NULL DEFAULT 0 COMMENT 'checker が float のときの許容絶対誤差',
+  ADD COLUMN relative_error DOUBLE NOT NULL DEFAULT 0 COMMENT 'checker が float のときの許容相対誤差',
+  ADD COLUMN checker_path VARCHAR(255) NOT NULL DEFAULT '' COMMENT 'checker が custom のときのチェッカーのソースのパス',
+  ADD COLUMN problem_type VARCHAR(32) NOT NULL DEFAULT '' COMMENT '空なら通常の問題、interactive か output_only',
+  ADD COLUMN interactor_path VARCHAR(255) NOT NULL DEFAULT '' COMMENT 'インタラクティブ問題のインタラクタのソースのパス';
+
+-- checker_message は 1024 バイト、mismatch_expected / mismatch_actual は 100 バイトまでに切り詰めて書き込む
+ALTER TABLE testcase_results
+  ADD COLUMN score DOUBLE NOT NULL DEFAULT 0 COMMENT 'チェッカーが返した部分点 (0 から 1)',
+  ADD COLUMN checker_message VARCHAR(1024) NOT NULL DEFAULT '' COMMENT 'チェッカーのメッセージ',
+  ADD COLUMN mismatch_line INT NOT NULL DEFAULT 0 COMMENT 'WA のとき最初に食い違った行 (1 から)',
+  ADD COLUMN mismatch_token INT NOT NULL DEFAULT 0 COMMENT 'WA のとき最初に食い違った行内のトークン (1 から)。行単位の比較では 0',
+  ADD COLUMN mismatch_expected VARCHAR(255) NOT NULL DEFAULT '' COMMENT '食い違った箇所の想定解',
+  ADD COLUMN mismatch_actual VARCHAR(255) NOT NULL DEFAULT '' COMMENT '食い違った箇所のユーザの出力';
@@ -0,0 +1,181 @@
+package checklib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/util"
+)
+
+// Outputs ... 判定対象の出力。チェッカーが必要としたときだけ取り出す。
+// UserOutput は上限を超えたら ErrOutputLimit を返す (LimitReader) ようにする
+type Outputs interface {
+	UserOutput(ctx context.Context) (io.ReadCloser, error)
+	Answer(ctx context.Context) (io.ReadCloser, error)
+}
+
+// Result ... チェッカーの判定結果
+type Result struct {
+	Status   string  // "AC", "WA", "PE"
+	Score    float64 // テストケースに対する得点率 (0 〜 1)
+	Message  string
+	Mismatch *Mismatch // 最初に一致しなかった箇所。わからなければ nil
+}
+
+// Mismatch ... ユーザの出力と想定解が最初に食い違った箇所
+type Mismatch struct {
+	Line     int    // 行番号 (1 始まり)
+	Token    int    // 行の中で何番目のトークンか (1 始まり)。行単位の比較では 0
+	Expected string // 想定解の該当部分 (snippetLimit バイトまで)。出力が尽きていれば EOF
+	Actual   string // ユーザの出力の該当部分 (snippetLimit バイトまで)。出力が尽きていれば EOF
+}
+
+// Mismatch に載せる文字列の最大バイト数
+const snippetLimit = 100
+
+// EOF ... Mismatch で出力が尽きていたことを表す
+const EOF = "<EOF>"
+
+// Checker ... ユーザの出力を判定する
+type Checker interface {
+	Check(ctx context.Context, outputs Outputs) (Result, error)
+}
+
+// Options ... チェッカーを作るときの問題ごとの設定
+type Options struct {
+	AbsoluteError float64 // "float" の許容絶対誤差
+	RelativeError float64 // "float" の許容相対誤差
+	Runner        Runner  // "custom" のチェッカープログラムの実行方法
+}
+
+// Factory ... 問題ごとの設定からチェッカーを作る
+type Factory func(options Options) (Checker, error)
+
+var registry = struct {
+	sync.RWMutex
+	factories map[string]Factory
+}{factories: make(map[string]Factory)}
+
+func init() {
+	Register("exact", func(Options) (Checker, error) { return streamChecker(compareExact), nil })
+	Register("whitespace", func(Options) (Checker, error) { return streamChecker(whitespaceComparer.compare), nil })
+	Register("case_insensitive", func(Options) (Checker, error) { return streamChecker(caseInsensitiveComparer.compare), nil })
+	Register("line_strict", func(Options) (Checker, error) { return streamChecker(lineStrictComparer.compare), nil })
+	Register("strict", func(Options) (Checker, error) { return strictChecker{}, nil })
+	Register("float", newFloatChecker)
+	Register("custom", newProgramChecker)
+}
+
+// Register ... チェッカーの種類 name を登録する。同じ名前で登録すると上書きする
+func Register(name string, factory Factory) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	registry.factories[name] = factory
+}
+
+// New ... 問題のチェッカーの種類 name からチェッカーを作る。
+// name が空なら空白・改行の違いを無視する "whitespace" を使う。
+func New(name string, options Options) (Checker, error) {
+	if name == "" {
+		name = "whitespace"
+	}
+
+	registry.RLock()
+	factory, exist := registry.factories[name]
+	registry.RUnlock()
+
+	if !exist {
+		return nil, fmt.Errorf("undefined checker: %s", name)
+	}
+
+	return factory(options)
+}
+
+// 出力を先頭から読みながら比較し、最初に食い違った箇所を返す関数をチェッカーにする。
+// ユーザの出力が上限を超えていたら (ErrOutputLimit) OLE にする。
+type streamChecker func(userOutput io.Reader, testOutput io.Reader) (*Mismatch, error)
+
+func (compare streamChecker) Check(ctx context.Context, outputs Outputs) (Result, error) {
+	mismatch, err := compareOutputs(ctx, outputs, compare)
+	if errors.Is(err, ErrOutputLimit) {
+		return Result{Status: "OLE"}, nil
+	}
+	if err != nil {
+		return Result{}, err
+	}
+
+	if mismatch != nil {
+		return Result{Status: "WA", Mismatch: mismatch}, nil
+	}
+	return Result{Status: "AC", Score: 1}, nil
+}
+
+// 出力を開いて compare で比較する
+func compareOutputs(ctx context.Context, outputs Outputs, compare streamChecker) (*Mismatch, error) {
+	userOutput, err := outputs.UserOutput(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer userOutput.Close()
+
+	testOutput, err := outputs.Answer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer testOutput.Close()
+
+	return compare(userOutput, testOutput)
+}
+
+// 書式まで厳密に比較する。トークンは一致していて空白・改行だけが違うなら PE、トークンが違えば WA
+type strictChecker struct{}
+
+func (strictChecker) Check(ctx context.Context, outputs Outputs) (Result, error) {
+	formatMismatch, err := compareOutputs(ctx, outputs, compareExact)
+	if errors.Is(err, ErrOutputLimit) {
+		return Result{Status: "OLE"}, nil
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	if formatMismatch == nil {
+		return Result{Status: "AC", Score: 1}, nil
+	}
+
+	// 書式が違うので、トークンだけで比較し直して PE か WA かを決める
+	tokenMismatch, err := compareOutputs(ctx, outputs, whitespaceComparer.compare)
+	if err != nil {
+		return Result{}, err
+	}
+	if tokenMismatch != nil {
+		return Result{Status: "WA", Mismatch: tokenMismatch}, nil
+	}
+	return Result{Status: "PE", Mismatch: formatMismatch}, nil
+}
+
+func newMismatch(line int, index int, expected string, actual string) *Mismatch {
+	return &Mismatch{
+		Line:     line,
+		Token:    index,
+		Expected: util.TruncateString(util.SanitizeString(expected), snippetLimit),
+		Actual:   util.TruncateString(util.SanitizeString(actual), snippetLimit),
+	}
+}
+
+func stringEqual(user string, test string) bool {
+	return user == test
+}
+
+// 空白・改行の違いを無視してトークンごとに比較する (Normal と同じ判定)
+var whitespaceComparer = tokenComparer{equal: stringEqual, chunkEqual: stringEqual}
+
+// トークンごとに大文字・小文字を区別せずに比較する
+var caseInsensitiveComparer = tokenComparer{equal: strings.EqualFold, chunkEqual: strings.EqualFold}
+
+// 各行のトークンが一致するかを判定する。行の中の空白の違いと末尾の空行は無視する
+var lineStrictComparer = tokenComparer{equal: stringEqual, chunkEqual: stringEqual, sameLine: true}
@@ -0,0 +1,101 @@
+package checklib
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// 文字列をそのまま出力として渡す Outputs。limit が正なら UserOutput をその大きさで打ち切る
+type stringOutputs struct {
+	user   string
+	answer string
+	limit  int64
+}
+
+func (outputs stringOutputs) UserOutput(ctx context.Context) (io.ReadCloser, error) {
+	if outputs.limit > 0 {
+		return ioutil.NopCloser(LimitReader(strings.NewReader(outputs.user), outputs.limit)), nil
+	}
+	return ioutil.NopCloser(strings.NewReader(outputs.user)), nil
+}
+
+func (outputs stringOutputs) Answer(ctx context.Context) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(outputs.answer)), nil
+}
+
+func TestStrictChecker(t *testing.T) {
+	tests := []struct {
+		name         string
+		outputs      stringOutputs
+		want         string
+		wantMismatch *Mismatch
+	}{
+		{name: "same", outputs: stringOutputs{user: "1 2\n3\n", answer: "1 2\n3\n"}, want: "AC"},
+		{name: "crlf", outputs: stringOutputs{user: "1 2\r\n3\r\n", answer: "1 2\n3\n"}, want: "AC"},
+		{name: "missing trailing newline", outputs: stringOutputs{user: "1 2\n3", answer: "1 2\n3\n"}, want: "AC"},
+		{name: "trailing space", outputs: stringOutputs{user: "1 2 \n3\n", answer: "1 2\n3\n"}, want: "PE", wantMismatch: &Mismatch{Line: 1, Expected: "1 2", Actual: "1 2 "}},
+		{name: "tokens on other lines", outputs: stringOutputs{user: "1\n2\n3\n", answer: "1 2\n3\n"}, want: "PE", wantMismatch: &Mismatch{Line: 1, Expected: "1 2", Actual: "1"}},
+		{name: "different token", outputs: stringOutputs{user: "1 2 \n4\n", answer: "1 2\n3\n"}, want: "WA", wantMismatch: &Mismatch{Line: 2, Token: 1, Expected: "3", Actual: "4"}},
+		{name: "invalid utf-8", outputs: stringOutputs{user: "1 2\n\xff😀\n", answer: "1 2\n3\n"}, want: "WA", wantMismatch: &Mismatch{Line: 2, Token: 1, Expected: "3", Actual: `�\U0001F600`}},
+		{name: "output limit", outputs: stringOutputs{user: "1 2\n3\n", answer: "1 2\n3\n", limit: 3}, want: "OLE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker, err := New("strict", Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := checker.Check(context.Background(), tt.outputs)
+			if err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			if result.Status != tt.want {
+				t.Errorf("Check() status = %s, want %s", result.Status, tt.want)
+			}
+			assertMismatch(t, result.Mismatch, tt.wantMismatch)
+		})
+	}
+}
+
+func TestStreamCheckers(t *testing.T) {
+	tests := []struct {
+		checker string
+		outputs stringOutputs
+		want    string
+	}{
+		{checker: "", outputs: stringOutputs{user: "1  2\n", answer: "1 2"}, want: "AC"},
+		{checker: "whitespace", outputs: stringOutputs{user: "1\n2\n", answer: "1 2"}, want: "AC"},
+		{checker: "whitespace", outputs: stringOutputs{user: "1 2 3", answer: "1 2", limit: 3}, want: "OLE"},
+		{checker: "exact", outputs: stringOutputs{user: "1  2\n", answer: "1 2\n"}, want: "WA"},
+		{checker: "case_insensitive", outputs: stringOutputs{user: "YES\n", answer: "Yes\n"}, want: "AC"},
+		{checker: "line_strict", outputs: stringOutputs{user: "1\n2\n", answer: "1 2\n"}, want: "WA"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.checker, func(t *testing.T) {
+			checker, err := New(tt.checker, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := checker.Check(context.Background(), tt.outputs)
+			if err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			if result.Status != tt.want {
+				t.Errorf("Check() status = %s, want %s", result.Status, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewUndefined(t *testing.T) {
+	if _, err := New("no_such_checker", Options{}); err == nil {
+		t.Error("New() error = nil, want error")
+	}
+}
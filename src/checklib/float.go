@@ -0,0 +1,59 @@
+package checklib
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DefaultFloatError ... 許容誤差が指定されていないときに使う絶対誤差・相対誤差
+const DefaultFloatError = 1e-6
+
+// 有限の数値として解釈できるか
+func parseFinite(token string) (float64, bool) {
+	f, err := strconv.ParseFloat(token, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+
+	return f, true
+}
+
+// Float ... トークンを数値として比較し、絶対誤差 absErr か相対誤差 relErr 以内なら一致とみなす。
+// 数値として解釈できないトークンは文字列として比較する。
+func Float(userOutput string, testOutput string, absErr float64, relErr float64) bool {
+	mismatch, _ := floatComparer(absErr, relErr).compare(strings.NewReader(userOutput), strings.NewReader(testOutput))
+	return mismatch == nil
+}
+
+func floatComparer(absErr float64, relErr float64) tokenComparer {
+	return tokenComparer{
+		equal: func(user string, test string) bool {
+			expected, ok1 := parseFinite(test)
+			actual, ok2 := parseFinite(user)
+			if !ok1 || !ok2 {
+				return user == test
+			}
+
+			diff := math.Abs(actual - expected)
+			return diff <= absErr || diff <= relErr*math.Abs(expected)
+		},
+		// 長いトークンは数値として扱わない
+		chunkEqual: stringEqual,
+	}
+}
+
+// 許容誤差がどちらも指定されていなければ DefaultFloatError を使う
+func newFloatChecker(options Options) (Checker, error) {
+	if options.AbsoluteError < 0 || options.RelativeError < 0 {
+		return nil, fmt.Errorf("negative float error: abs=%g rel=%g", options.AbsoluteError, options.RelativeError)
+	}
+
+	absErr, relErr := options.AbsoluteError, options.RelativeError
+	if absErr == 0 && relErr == 0 {
+		absErr, relErr = DefaultFloatError, DefaultFloatError
+	}
+
+	return streamChecker(floatComparer(absErr, relErr).compare), nil
+}
@@ -0,0 +1,81 @@
+package checklib
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFloat(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   string
+		test   string
+		absErr float64
+		relErr float64
+		equal  bool
+	}{
+		{name: "same", user: "1.5 2", test: "1.5 2", absErr: 1e-6, equal: true},
+		{name: "within absolute error", user: "1.0000005", test: "1", absErr: 1e-6, equal: true},
+		{name: "outside absolute error", user: "1.00001", test: "1", absErr: 1e-6},
+		{name: "within relative error", user: "1000000.5", test: "1000000", relErr: 1e-6, equal: true},
+		{name: "outside relative error", user: "1000002", test: "1000000", relErr: 1e-6},
+		{name: "relative error is not used for small values", user: "0.0000011", test: "0.000001", absErr: 1e-9, relErr: 1e-6},
+		{name: "absolute or relative", user: "1000000.5", test: "1000000", absErr: 1e-6, relErr: 1e-6, equal: true},
+		{name: "relative error of expected value", user: "2000", test: "1000", relErr: 0.6},
+		{name: "exponent", user: "1e3", test: "1000.0000001", absErr: 1e-6, equal: true},
+		{name: "negative", user: "-0.5", test: "-0.5000001", absErr: 1e-6, equal: true},
+		{name: "nan is compared as string", user: "nan", test: "nan", absErr: 1e-6, equal: true},
+		{name: "nan does not match a number", user: "nan", test: "1", absErr: 1e6},
+		{name: "nan does not match different nan", user: "NaN", test: "nan", absErr: 1e6},
+		{name: "inf is compared as string", user: "inf", test: "inf", absErr: 1e-6, equal: true},
+		{name: "inf does not match a large number", user: "inf", test: "1e308", relErr: 1e6},
+		{name: "overflow is not a number", user: "1e400", test: "1e308", relErr: 1e6},
+		{name: "non-number tokens", user: "Yes 1.0000001", test: "Yes 1", absErr: 1e-6, equal: true},
+		{name: "non-number tokens differ", user: "yes 1", test: "Yes 1", absErr: 1e-6},
+		{name: "missing token", user: "1", test: "1 2", absErr: 1e-6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Float(tt.user, tt.test, tt.absErr, tt.relErr); got != tt.equal {
+				t.Errorf("Float(%q, %q, %g, %g) = %v, want %v", tt.user, tt.test, tt.absErr, tt.relErr, got, tt.equal)
+			}
+		})
+	}
+}
+
+func TestNewFloatChecker(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		user    string
+		want    string
+		wantErr bool
+	}{
+		{name: "default error", user: "1.0000005", want: "AC"},
+		{name: "default error exceeded", user: "1.00001", want: "WA"},
+		{name: "given absolute error", options: Options{AbsoluteError: 1e-3}, user: "1.0005", want: "AC"},
+		{name: "only relative error", options: Options{RelativeError: 1e-9}, user: "1.0000005", want: "WA"},
+		{name: "negative error", options: Options{AbsoluteError: -1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker, err := New("float", tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			result, err := checker.Check(context.Background(), stringOutputs{user: tt.user, answer: "1"})
+			if err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			if result.Status != tt.want {
+				t.Errorf("Check() status = %s, want %s", result.Status, tt.want)
+			}
+		})
+	}
+}
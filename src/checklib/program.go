@@ -0,0 +1,85 @@
+package checklib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// testlib.h の終了コード
+const (
+	testlibOK            = 0
+	testlibWA            = 1
+	testlibPE            = 2
+	testlibFail          = 3
+	testlibDirt          = 4
+	testlibPoints        = 7
+	testlibUnexpectedEOF = 8
+)
+
+// Runner ... サンドボックス内で問題のチェッカープログラムを実行し、終了コードとメッセージ (標準エラー出力) を返す
+type Runner interface {
+	RunChecker(ctx context.Context) (exitCode int, message string, err error)
+}
+
+// 問題のチェッカープログラム (testlib.h 準拠) で判定する
+type programChecker struct {
+	runner Runner
+}
+
+func newProgramChecker(options Options) (Checker, error) {
+	if options.Runner == nil {
+		return nil, errors.New("custom checker requires a runner")
+	}
+
+	return &programChecker{runner: options.Runner}, nil
+}
+
+func (checker *programChecker) Check(ctx context.Context, outputs Outputs) (Result, error) {
+	exitCode, message, err := checker.runner.RunChecker(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return TestlibResult(exitCode, message)
+}
+
+// TestlibResult ... testlib.h のチェッカー・インタラクタの終了コードとメッセージを判定結果に変換する
+func TestlibResult(exitCode int, message string) (Result, error) {
+	result := Result{Message: strings.TrimSpace(message)}
+
+	switch exitCode {
+	case testlibOK:
+		result.Status = "AC"
+		result.Score = 1
+	case testlibWA:
+		result.Status = "WA"
+	case testlibPE, testlibDirt, testlibUnexpectedEOF:
+		result.Status = "PE"
+	case testlibPoints:
+		// quitp の出力は "points <点数> <メッセージ>"。点数はテストケースに対する割合 (0 〜 1) として扱う
+		var score float64
+		if _, err := fmt.Sscanf(strings.TrimPrefix(result.Message, "points "), "%g", &score); err != nil {
+			return result, fmt.Errorf("invalid points: %s", result.Message)
+		}
+		if score < 0 {
+			score = 0
+		} else if score > 1 {
+			score = 1
+		}
+
+		result.Score = score
+		if score == 1 {
+			result.Status = "AC"
+		} else {
+			result.Status = "WA"
+		}
+	case testlibFail:
+		return result, fmt.Errorf("judge program failed: %s", result.Message)
+	default:
+		return result, fmt.Errorf("judge program exited with unexpected code %d: %s", exitCode, result.Message)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,313 @@
+package checklib
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// 長いトークンを分けて比較するときの単位 (バイト)。
+// 比較に使うメモリはこの大きさで抑えられ、出力の大きさにはよらない。
+const chunkSize = 4096
+
+// ErrOutputLimit ... ユーザの出力が上限を超えた
+var ErrOutputLimit = errors.New("output limit exceeded")
+
+// LimitReader ... limit バイトを超えて読もうとすると ErrOutputLimit を返す io.Reader
+func LimitReader(reader io.Reader, limit int64) io.Reader {
+	return &limitedReader{reader: reader, remain: limit}
+}
+
+type limitedReader struct {
+	reader io.Reader
+	remain int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.remain < 0 {
+		return 0, ErrOutputLimit
+	}
+
+	// 上限ちょうどで終わっているかを見分けるために 1 バイト余計に読む
+	if int64(len(p)) > lr.remain+1 {
+		p = p[:lr.remain+1]
+	}
+	n, err := lr.reader.Read(p)
+	lr.remain -= int64(n)
+	if lr.remain < 0 {
+		return n, ErrOutputLimit
+	}
+
+	return n, err
+}
+
+func isSeparator(b byte) bool {
+	return b == ' ' || b == '\n' || b == '\r'
+}
+
+func isContinuationByte(b byte) bool {
+	return b&0xC0 == 0x80
+}
+
+// 出力を空白・改行区切りのトークンとして少しずつ読む
+type tokenReader struct {
+	reader *bufio.Reader
+	line   int // 現在の行 (1 始まり)
+	index  int // 現在の行で何番目のトークンか
+	chunk  []byte
+}
+
+func newTokenReader(reader io.Reader) *tokenReader {
+	return &tokenReader{
+		reader: bufio.NewReader(reader),
+		line:   1,
+		chunk:  make([]byte, 0, chunkSize+utf8MaxContinuation),
+	}
+}
+
+// 区切り文字を読み飛ばして次のトークンの先頭に進む。出力が尽きていれば false
+func (tr *tokenReader) next() (bool, error) {
+	for {
+		b, err := tr.reader.ReadByte()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		switch b {
+		case ' ':
+		case '\r':
+			// "\r\n" は 1 つの改行として数える
+			if next, err := tr.reader.Peek(1); err == nil && next[0] == '\n' {
+				_, _ = tr.reader.ReadByte()
+			}
+			tr.line++
+			tr.index = 0
+		case '\n':
+			tr.line++
+			tr.index = 0
+		default:
+			_ = tr.reader.UnreadByte()
+			tr.index++
+			return true, nil
+		}
+	}
+}
+
+// 現在のトークンを chunkSize バイト程度まで読む。マルチバイト文字の途中では切らない。
+// トークンの終わりまで読めたら end は true
+func (tr *tokenReader) readChunk() (string, bool, error) {
+	chunk := tr.chunk[:0]
+
+	for {
+		bytes, err := tr.reader.Peek(1)
+		if err == io.EOF {
+			return string(chunk), true, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+
+		b := bytes[0]
+		if isSeparator(b) {
+			return string(chunk), true, nil
+		}
+		if len(chunk) >= chunkSize && !isContinuationByte(b) {
+			return string(chunk), false, nil
+		}
+
+		_, _ = tr.reader.ReadByte()
+		chunk = append(chunk, b)
+	}
+}
+
+// UTF-8 で 1 文字の先頭バイトに続くバイトの最大数
+const utf8MaxContinuation = 3
+
+// トークンの比較方法
+type tokenComparer struct {
+	equal      func(user string, test string) bool // chunkSize 以内のトークン全体の比較
+	chunkEqual func(user string, test string) bool // chunkSize より長いトークンを分けて比較するとき
+	sameLine   bool                                // トークンが同じ行にあることも求めるか
+}
+
+// compare ... 2 つの出力を先頭からトークンごとに比較し、最初に食い違った箇所を返す
+func (comparer tokenComparer) compare(userOutput io.Reader, testOutput io.Reader) (*Mismatch, error) {
+	user := newTokenReader(userOutput)
+	test := newTokenReader(testOutput)
+
+	for {
+		userOK, err := user.next()
+		if err != nil {
+			return nil, err
+		}
+		testOK, err := test.next()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case !userOK && !testOK:
+			return nil, nil
+		case !userOK:
+			expected, _, err := test.readChunk()
+			return newMismatch(test.line, test.index, expected, EOF), err
+		case !testOK:
+			actual, _, err := user.readChunk()
+			return newMismatch(user.line, user.index, EOF, actual), err
+		}
+
+		line, index := user.line, user.index
+		for first := true; ; first = false {
+			actual, userEnd, err := user.readChunk()
+			if err != nil {
+				return nil, err
+			}
+			expected, testEnd, err := test.readChunk()
+			if err != nil {
+				return nil, err
+			}
+
+			equal := comparer.chunkEqual
+			if first && userEnd && testEnd {
+				equal = comparer.equal
+			}
+			if userEnd != testEnd || !equal(actual, expected) {
+				return newMismatch(line, index, expected, actual), nil
+			}
+			if comparer.sameLine && user.line != test.line {
+				return newMismatch(line, index, expected, actual), nil
+			}
+
+			if userEnd {
+				break
+			}
+		}
+	}
+}
+
+// 改行コードを "\n" に揃えながら 1 バイトずつ読む。行番号と行の先頭部分を記録する
+type lineReader struct {
+	reader  *bufio.Reader
+	line    int
+	head    []byte // 現在の行の先頭 snippetLimit バイト
+	newline bool   // 直前に改行を返した
+}
+
+func newLineReader(reader io.Reader) *lineReader {
+	return &lineReader{reader: bufio.NewReader(reader), line: 1}
+}
+
+// 次の 1 バイトを返す。出力が尽きていれば ok は false
+func (lr *lineReader) readByte() (byte, bool, error) {
+	if lr.newline {
+		lr.line++
+		lr.head = lr.head[:0]
+		lr.newline = false
+	}
+
+	b, err := lr.reader.ReadByte()
+	if err == io.EOF {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	if b == '\r' {
+		if next, err := lr.reader.Peek(1); err == nil && next[0] == '\n' {
+			_, _ = lr.reader.ReadByte()
+		}
+		b = '\n'
+	}
+
+	if b == '\n' {
+		lr.newline = true
+	} else if len(lr.head) < snippetLimit+utf8MaxContinuation {
+		lr.head = append(lr.head, b)
+	}
+
+	return b, true, nil
+}
+
+// 残りが改行だけか
+func (lr *lineReader) onlyNewlines() (bool, error) {
+	for {
+		b, ok, err := lr.readByte()
+		if err != nil || !ok {
+			return true, err
+		}
+		if b != '\n' {
+			return false, nil
+		}
+	}
+}
+
+// 読み終えた行の途中にいるか
+func (lr *lineReader) inLine() bool {
+	return !lr.newline && len(lr.head) > 0
+}
+
+// 現在の行の内容を snippetLimit バイト程度まで返す
+func (lr *lineReader) snippet() (string, error) {
+	for !lr.newline && len(lr.head) < snippetLimit+utf8MaxContinuation {
+		if _, ok, err := lr.readByte(); err != nil || !ok {
+			return string(lr.head), err
+		}
+	}
+
+	return string(lr.head), nil
+}
+
+// compareExact ... 改行コードの違いと末尾の改行だけを無視して、2 つの出力が完全に一致するかを比較する
+func compareExact(userOutput io.Reader, testOutput io.Reader) (*Mismatch, error) {
+	user := newLineReader(userOutput)
+	test := newLineReader(testOutput)
+
+	for {
+		userByte, userOK, err := user.readByte()
+		if err != nil {
+			return nil, err
+		}
+		testByte, testOK, err := test.readByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case !userOK && !testOK:
+			return nil, nil
+		case !userOK && testByte == '\n':
+			if ok, err := test.onlyNewlines(); ok || err != nil {
+				return nil, err
+			}
+		case !testOK && userByte == '\n':
+			if ok, err := user.onlyNewlines(); ok || err != nil {
+				return nil, err
+			}
+		case userOK && testOK && userByte == testByte:
+			continue
+		}
+
+		line := user.line
+		if !userOK {
+			line = test.line
+		}
+
+		expected, actual := EOF, EOF
+		if testOK || test.inLine() {
+			if expected, err = test.snippet(); err != nil {
+				return nil, err
+			}
+		}
+		if userOK || user.inLine() {
+			if actual, err = user.snippet(); err != nil {
+				return nil, err
+			}
+		}
+
+		return newMismatch(line, 0, expected, actual), nil
+	}
+}
@@ -0,0 +1,167 @@
+package checklib
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestWhitespaceComparer(t *testing.T) {
+	long := strings.Repeat("a", chunkSize*2+10)
+	// chunkSize バイト目がマルチバイト文字の途中になる
+	multibyte := strings.Repeat("a", chunkSize-1) + strings.Repeat("あ", 10)
+
+	tests := []struct {
+		name         string
+		user         string
+		test         string
+		wantMismatch *Mismatch
+	}{
+		{name: "same", user: "1 2\n3\n", test: "1 2\n3\n"},
+		{name: "trailing whitespace", user: "1 2  \n3\n\n\n", test: "1 2\n3"},
+		{name: "leading whitespace", user: "\n  1 2\n3\n", test: "1 2\n3\n"},
+		{name: "crlf", user: "1 2\r\n3\r\n", test: "1 2\n3\n"},
+		{name: "tokens on other lines", user: "1\n2\n3\n", test: "1 2 3\n"},
+		{name: "empty", user: "", test: ""},
+		{name: "only whitespace", user: " \r\n\n", test: ""},
+		{name: "different token", user: "1 2\n4\n", test: "1 2\n3\n", wantMismatch: &Mismatch{Line: 2, Token: 1, Expected: "3", Actual: "4"}},
+		{name: "crlf line number", user: "1\r\n2\r\n4\r\n", test: "1\n2\n3\n", wantMismatch: &Mismatch{Line: 3, Token: 1, Expected: "3", Actual: "4"}},
+		{name: "user output too short", user: "1 2\n", test: "1 2\n3\n", wantMismatch: &Mismatch{Line: 2, Token: 1, Expected: "3", Actual: EOF}},
+		{name: "user output too long", user: "1 2\n3\n", test: "1 2\n", wantMismatch: &Mismatch{Line: 2, Token: 1, Expected: EOF, Actual: "3"}},
+		{name: "prefix token", user: "12", test: "123", wantMismatch: &Mismatch{Line: 1, Token: 1, Expected: "123", Actual: "12"}},
+		{name: "long token", user: long + " 1", test: long + " 1"},
+		// 長いトークンでは食い違った chunk を載せる
+		{name: "long token differs after first chunk", user: long + "b", test: long + "c", wantMismatch: &Mismatch{Line: 1, Token: 1, Expected: "aaaaaaaaaac", Actual: "aaaaaaaaaab"}},
+		{name: "long token shorter", user: long[:chunkSize+1], test: long, wantMismatch: &Mismatch{Line: 1, Token: 1, Expected: long[:snippetLimit], Actual: "a"}},
+		{name: "token ends at chunk boundary", user: long[:chunkSize] + " x", test: long[:chunkSize] + " x"},
+		{name: "multibyte at chunk boundary", user: multibyte, test: multibyte},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mismatch, err := whitespaceComparer.compare(strings.NewReader(tt.user), strings.NewReader(tt.test))
+			if err != nil {
+				t.Fatalf("compare() error = %v", err)
+			}
+			assertMismatch(t, mismatch, tt.wantMismatch)
+		})
+	}
+}
+
+func TestLineStrictComparer(t *testing.T) {
+	tests := []struct {
+		name  string
+		user  string
+		test  string
+		equal bool
+	}{
+		{name: "same", user: "1 2\n3\n", test: "1 2\n3\n", equal: true},
+		{name: "spaces in line", user: "1   2\n3\n", test: "1 2\n3\n", equal: true},
+		{name: "trailing newlines", user: "1 2\n3\n\n\n", test: "1 2\n3", equal: true},
+		{name: "crlf", user: "1 2\r\n3\r\n", test: "1 2\n3\n", equal: true},
+		{name: "tokens on other lines", user: "1\n2\n3\n", test: "1 2\n3\n"},
+		{name: "joined lines", user: "1 2 3\n", test: "1 2\n3\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mismatch, err := lineStrictComparer.compare(strings.NewReader(tt.user), strings.NewReader(tt.test))
+			if err != nil {
+				t.Fatalf("compare() error = %v", err)
+			}
+			if (mismatch == nil) != tt.equal {
+				t.Errorf("compare() = %+v, want equal %v", mismatch, tt.equal)
+			}
+		})
+	}
+}
+
+func TestCompareExact(t *testing.T) {
+	tests := []struct {
+		name         string
+		user         string
+		test         string
+		wantMismatch *Mismatch
+	}{
+		{name: "same", user: "1 2\n3\n", test: "1 2\n3\n"},
+		{name: "crlf", user: "1 2\r\n3\r\n", test: "1 2\n3\n"},
+		{name: "cr", user: "1 2\r3\r", test: "1 2\n3\n"},
+		{name: "missing trailing newline", user: "1 2\n3", test: "1 2\n3\n"},
+		{name: "extra trailing newlines", user: "1 2\n3\n\n\n", test: "1 2\n3\n"},
+		{name: "empty", user: "", test: ""},
+		{name: "trailing space", user: "1 2 \n3\n", test: "1 2\n3\n", wantMismatch: &Mismatch{Line: 1, Expected: "1 2", Actual: "1 2 "}},
+		{name: "double space", user: "1  2\n", test: "1 2\n", wantMismatch: &Mismatch{Line: 1, Expected: "1 2", Actual: "1  2"}},
+		{name: "extra blank line in the middle", user: "1\n\n2\n", test: "1\n2\n", wantMismatch: &Mismatch{Line: 2, Expected: "2", Actual: ""}},
+		{name: "user output too short", user: "1\n", test: "1\n2\n", wantMismatch: &Mismatch{Line: 2, Expected: "2", Actual: EOF}},
+		{name: "user output too long", user: "1\n2\n", test: "1\n", wantMismatch: &Mismatch{Line: 2, Expected: EOF, Actual: "2"}},
+		{name: "user output ends in line", user: "1\n2", test: "1\n23\n", wantMismatch: &Mismatch{Line: 2, Expected: "23", Actual: "2"}},
+		{name: "long line", user: strings.Repeat("a", 300) + "b\n", test: strings.Repeat("a", 300) + "c\n", wantMismatch: &Mismatch{Line: 1, Expected: strings.Repeat("a", snippetLimit), Actual: strings.Repeat("a", snippetLimit)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mismatch, err := compareExact(strings.NewReader(tt.user), strings.NewReader(tt.test))
+			if err != nil {
+				t.Fatalf("compareExact() error = %v", err)
+			}
+			assertMismatch(t, mismatch, tt.wantMismatch)
+		})
+	}
+}
+
+func TestLimitReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		limit   int64
+		wantErr error
+	}{
+		{name: "under limit", input: "abc", limit: 4},
+		{name: "exactly limit", input: "abcd", limit: 4},
+		{name: "over limit", input: "abcde", limit: 4, wantErr: ErrOutputLimit},
+		{name: "zero limit with empty input", input: "", limit: 0},
+		{name: "zero limit", input: "a", limit: 0, wantErr: ErrOutputLimit},
+		{name: "far over limit", input: strings.Repeat("a", 3*chunkSize), limit: chunkSize, wantErr: ErrOutputLimit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := ioutil.ReadAll(LimitReader(strings.NewReader(tt.input), tt.limit))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReadAll() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && string(content) != tt.input {
+				t.Errorf("ReadAll() = %q, want %q", content, tt.input)
+			}
+			if int64(len(content)) > tt.limit+1 {
+				t.Errorf("read %d bytes, want at most %d", len(content), tt.limit+1)
+			}
+		})
+	}
+}
+
+// ErrOutputLimit は比較の途中でも返ってくる
+func TestComparerOutputLimit(t *testing.T) {
+	user := LimitReader(strings.NewReader("1 2 3 4 5"), 4)
+	if _, err := whitespaceComparer.compare(user, strings.NewReader("1 2 3 4 5")); !errors.Is(err, ErrOutputLimit) {
+		t.Errorf("compare() error = %v, want %v", err, ErrOutputLimit)
+	}
+
+	user = LimitReader(strings.NewReader("1 2 3 4 5"), 4)
+	if _, err := compareExact(user, strings.NewReader("1 2 3 4 5")); !errors.Is(err, ErrOutputLimit) {
+		t.Errorf("compareExact() error = %v, want %v", err, ErrOutputLimit)
+	}
+}
+
+func assertMismatch(t *testing.T, got *Mismatch, want *Mismatch) {
+	t.Helper()
+
+	switch {
+	case got == nil && want == nil:
+	case got == nil || want == nil:
+		t.Errorf("mismatch = %+v, want %+v", got, want)
+	case *got != *want:
+		t.Errorf("mismatch = %+v, want %+v", *got, *want)
+	}
+}
@@ -1,40 +1,103 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/cafecoder-dev/cafecoder-judge/src/cmdlib"
+	"github.com/cafecoder-dev/cafecoder-judge/src/dkrlib"
 	"github.com/cafecoder-dev/cafecoder-judge/src/judgelib"
+	"github.com/cafecoder-dev/cafecoder-judge/src/langconf"
 	"github.com/cafecoder-dev/cafecoder-judge/src/sqllib"
 	"github.com/cafecoder-dev/cafecoder-judge/src/types"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
 )
 
-// JudgeNumberLimit ... limits the number of judges
-//
-// see: https://mattn.kaoriya.net/software/lang/go/20171221111857.htm
+// MaxJudge ... 並列で処理するジャッジの最大値。ビルド時に -ldflags で埋め込む
 var MaxJudge string
-var JudgeNumberLimit chan struct{}
 
 func main() {
+	// local の Sandbox の前処理として実行されたときは、ここでコマンドを exec して戻らない
+	dkrlib.RunSandboxInit()
+
 	m, err := strconv.Atoi(MaxJudge)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	JudgeNumberLimit = make(chan struct{}, m)
+	if err := langconf.Load(langconf.ConfigPath); err != nil {
+		log.Fatal(err)
+	}
 
-	cmdChickets := cmdlib.CmdTicket{Channel: make(map[string]chan types.CmdResultJSON)}
-	go cmdlib.ManageCmds(&cmdChickets)
+	// ジャッジ中の提出
+	judging := &judgingSubmits{submits: make(map[int64]judgingSubmit)}
+
+	// SIGINT・SIGTERM を受けたらジャッジ中の提出をすべて打ち切って終わる
+	ctx, stop := context.WithCancel(context.Background())
+	go cancelOnSignal(stop)
 
 	db, err := sqllib.NewDB()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for {
+	// .env は sqllib.NewDB で読み込まれている
+	backend, err := newBackend()
+	if err != nil {
+		log.Fatal(err)
+	}
+	checkImages(backend)
+	go reloadLangConfOnSignal(backend)
+
+	// コンテナクライアントとの通信方式。tcp (既定) か grpc。
+	// legacy は署名のない以前のコンテナクライアントを移行のあいだだけ動かすためのもので、docker でしか使えない
+	switch protocol := os.Getenv("AGENT_PROTOCOL"); protocol {
+	case "", cmdlib.ProtocolTCP, cmdlib.ProtocolGRPC:
+		cmdlib.Protocol = protocol
+	case cmdlib.ProtocolLegacy:
+		if _, ok := backend.(dkrlib.DockerBackend); !ok {
+			log.Fatal("AGENT_PROTOCOL=legacy requires SANDBOX_BACKEND=docker")
+		}
+		log.Println("warning: AGENT_PROTOCOL=legacy does not sign messages; use it only while migrating agents")
+		cmdlib.Protocol = protocol
+		go func() {
+			if err := cmdlib.ListenLegacy(ctx); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	default:
+		log.Fatalf("unknown AGENT_PROTOCOL %q", protocol)
+	}
+
+	pool, err := newPool(backend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pool.Warm(dkrlib.DefaultImage)
+
+	// ジャッジの枠。空いている枠がなければ、どれかのジャッジが終わるまで待つ
+	slots, checkerSlot, err := newSlots(m)
+	if err != nil {
+		log.Fatal(err)
+	}
+	freeSlots := make(chan dkrlib.Slot, len(slots))
+	for _, slot := range slots {
+		freeSlots <- slot
+	}
+
+	var judges sync.WaitGroup
+
+	for ctx.Err() == nil {
 		var res []types.SubmitsGORM
 
 		if result := db.Table("submits").
@@ -45,26 +108,376 @@ func main() {
 			log.Fatal(err)
 		}
 
-		for _, elem := range res {
-			cmdChickets.Lock()
-			_, exist := cmdChickets.Channel[fmt.Sprintf("%d", elem.ID)]
-			cmdChickets.Unlock()
+		judging.cancelStale(db)
 
-			if exist {
+		for _, elem := range res {
+			if judging.exist(elem.ID) {
+				continue
+			} else if waitsForImage(db, elem) {
+				// イメージが用意できるまで WJ のまま待たせる
 				continue
 			} else {
-				// wait until the number of judges becomes less than maxJudge
-				JudgeNumberLimit <- struct{}{}
+				var slot dkrlib.Slot
+				select {
+				case slot = <-freeSlots:
+				case <-ctx.Done():
+				}
+				if ctx.Err() != nil {
+					break
+				}
+
+				judgeCtx, cancel := context.WithCancel(ctx)
+				judging.add(elem, cancel)
+				judges.Add(1)
 
-				cmdChickets.Lock()
-				cmdChickets.Channel[fmt.Sprintf("%d", elem.ID)] = make(chan types.CmdResultJSON)
-				cmdChickets.Unlock()
+				go func(submit types.SubmitsGORM, slot dkrlib.Slot) {
+					defer judges.Done()
 
-				go func() {
-					judgelib.Judge(elem, &cmdChickets)
-					<-JudgeNumberLimit
-				}()
+					judgelib.Judge(judgeCtx, submit, pool, slot, checkerSlot)
+					freeSlots <- slot
+
+					judging.remove(submit.ID)
+				}(elem, slot)
 			}
 		}
 	}
+
+	log.Println("shutting down: waiting for judges to stop")
+	judges.Wait()
+	pool.Close(context.Background())
+}
+
+// ジャッジ中の提出
+type judgingSubmits struct {
+	sync.Mutex
+	submits map[int64]judgingSubmit
+}
+
+type judgingSubmit struct {
+	status    string // ジャッジを始めたときの status
+	updatedAt string // ジャッジを始めたときの updated_at
+	cancel    context.CancelFunc
+	canceled  bool
+}
+
+func (judging *judgingSubmits) exist(id int64) bool {
+	judging.Lock()
+	defer judging.Unlock()
+
+	_, exist := judging.submits[id]
+	return exist
+}
+
+func (judging *judgingSubmits) add(submit types.SubmitsGORM, cancel context.CancelFunc) {
+	judging.Lock()
+	defer judging.Unlock()
+
+	judging.submits[submit.ID] = judgingSubmit{status: submit.Status, updatedAt: submit.UpdatedAt, cancel: cancel}
+}
+
+func (judging *judgingSubmits) remove(id int64) {
+	judging.Lock()
+	defer judging.Unlock()
+
+	if submit, exist := judging.submits[id]; exist {
+		submit.cancel()
+		delete(judging.submits, id)
+	}
+}
+
+// 削除された提出と、ジャッジ中にリジャッジが要求された提出のジャッジを打ち切る。
+// ジャッジは status を WR にしないので、WR になっていて updated_at が変わっていればリジャッジの要求とみなす
+func (judging *judgingSubmits) cancelStale(db *gorm.DB) {
+	judging.Lock()
+	defer judging.Unlock()
+
+	if len(judging.submits) == 0 {
+		return
+	}
+	ids := make([]int64, 0, len(judging.submits))
+	for id := range judging.submits {
+		ids = append(ids, id)
+	}
+
+	var rows []struct {
+		ID        int64   `gorm:"column:id"`
+		Status    string  `gorm:"column:status"`
+		UpdatedAt string  `gorm:"column:updated_at"`
+		DeletedAt *string `gorm:"column:deleted_at"`
+	}
+	if err := db.Table("submits").
+		Select("id, status, updated_at, deleted_at").
+		Where("id IN (?)", ids).
+		Find(&rows).
+		Error; err != nil {
+		log.Printf("checking judging submits failed: %s\n", err)
+		return
+	}
+
+	found := make(map[int64]bool)
+	for _, row := range rows {
+		found[row.ID] = true
+
+		if row.DeletedAt != nil {
+			judging.cancel(row.ID, "submit was deleted")
+		} else if submit := judging.submits[row.ID]; row.Status == "WR" && (submit.status != "WR" || row.UpdatedAt != submit.updatedAt) {
+			judging.cancel(row.ID, "rejudge was requested")
+		}
+	}
+	for _, id := range ids {
+		if !found[id] {
+			judging.cancel(id, "submit was deleted")
+		}
+	}
+}
+
+// id のジャッジを打ち切る。Lock してから呼ぶこと
+func (judging *judgingSubmits) cancel(id int64, reason string) {
+	submit := judging.submits[id]
+	if submit.canceled {
+		return
+	}
+
+	log.Printf("submit %d: %s, cancel judge\n", id, reason)
+	submit.cancel()
+	submit.canceled = true
+	judging.submits[id] = submit
+}
+
+// 提出の言語のイメージが使えないので、ジャッジせずに待たせるか。
+// 出力のみの問題では提出の言語を使わないので待たせない。問題が読めなければ、これまでどおり待たせる
+func waitsForImage(db *gorm.DB, submit types.SubmitsGORM) bool {
+	if langconf.Available(submit.Lang) == nil {
+		return false
+	}
+
+	var problem types.ProblemsGORM
+	if err := db.Table("problems").
+		Select("problem_type").
+		Where("id = ? AND deleted_at IS NULL", submit.ProblemID).
+		First(&problem).
+		Error; err != nil {
+		return true
+	}
+
+	return problem.ProblemType != "output_only"
+}
+
+// SIGINT・SIGTERM を受けたら cancel を呼ぶ
+func cancelOnSignal(cancel context.CancelFunc) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	<-sig
+	log.Println("signal received, canceling judges")
+	cancel()
+}
+
+// 環境変数から backend で Sandbox を作る Pool を作る
+func newPool(backend dkrlib.Backend) (*dkrlib.Pool, error) {
+	var (
+		config dkrlib.PoolConfig
+		err    error
+	)
+
+	if size := os.Getenv("CONTAINER_POOL_SIZE"); size != "" {
+		if config.Size, err = strconv.Atoi(size); err != nil {
+			return nil, fmt.Errorf("CONTAINER_POOL_SIZE: %w", err)
+		}
+	}
+	if maxUses := os.Getenv("CONTAINER_MAX_USES"); maxUses != "" {
+		if config.MaxUses, err = strconv.Atoi(maxUses); err != nil {
+			return nil, fmt.Errorf("CONTAINER_MAX_USES: %w", err)
+		}
+	}
+	if resetCmd := os.Getenv("CONTAINER_RESET_CMD"); resetCmd != "" {
+		config.ResetCmd = []string{"sh", "-c", resetCmd}
+	}
+	// legacy のコンテナクライアントはトークンを変えられないので使い回さない
+	if cmdlib.Protocol != cmdlib.ProtocolLegacy {
+		config.Rekey = func(ctx context.Context, sandbox dkrlib.Sandbox, token string) error {
+			return cmdlib.Rekey(ctx, sandbox.Address(), sandbox.Token(), token)
+		}
+	}
+	config.HealthCheck = func(ctx context.Context, sandbox dkrlib.Sandbox) error {
+		return cmdlib.Ping(ctx, sandbox.Address(), sandbox.Token())
+	}
+
+	return dkrlib.NewPool(backend, config), nil
+}
+
+// 環境変数 SANDBOX_BACKEND から提出を動かす環境を選ぶ。既定は docker
+func newBackend() (dkrlib.Backend, error) {
+	switch backend := os.Getenv("SANDBOX_BACKEND"); backend {
+	case "", "docker":
+		sandbox, err := newSandboxConfig()
+		if err != nil {
+			return nil, err
+		}
+		return dkrlib.DockerBackend{APIVersion: os.Getenv("DOCKER_API_VERSION"), Sandbox: sandbox}, nil
+	case "local":
+		local := dkrlib.LocalBackend{
+			ImageDir:  os.Getenv("LOCAL_SANDBOX_IMAGE_DIR"),
+			WorkDir:   os.Getenv("LOCAL_SANDBOX_WORK_DIR"),
+			CgroupDir: os.Getenv("LOCAL_SANDBOX_CGROUP_DIR"),
+			AgentCmd:  strings.Fields(os.Getenv("LOCAL_SANDBOX_AGENT_CMD")),
+		}
+		if uid := os.Getenv("LOCAL_SANDBOX_HOST_UID"); uid != "" {
+			var err error
+			if local.HostUID, err = strconv.Atoi(uid); err != nil {
+				return nil, fmt.Errorf("LOCAL_SANDBOX_HOST_UID: %w", err)
+			}
+		}
+		return local, nil
+	default:
+		return nil, fmt.Errorf("SANDBOX_BACKEND: unknown backend %q", backend)
+	}
+}
+
+// 環境変数から n 個のジャッジの枠と、問題のチェッカー・インタラクタの枠を作る。JUDGE_CPUS がなければ CPU を割り当てない
+func newSlots(n int) ([]dkrlib.Slot, dkrlib.Slot, error) {
+	cpus, err := dkrlib.ParseCPUList(os.Getenv("JUDGE_CPUS"))
+	if err != nil {
+		return nil, dkrlib.Slot{}, fmt.Errorf("JUDGE_CPUS: %w", err)
+	}
+
+	cpusPerSlot := 1
+	if perSlot := os.Getenv("JUDGE_CPUS_PER_SLOT"); perSlot != "" {
+		if cpusPerSlot, err = strconv.Atoi(perSlot); err != nil {
+			return nil, dkrlib.Slot{}, fmt.Errorf("JUDGE_CPUS_PER_SLOT: %w", err)
+		}
+	}
+
+	cpuQuota := 0.0
+	if quota := os.Getenv("JUDGE_CPU_QUOTA"); quota != "" {
+		if cpuQuota, err = strconv.ParseFloat(quota, 64); err != nil {
+			return nil, dkrlib.Slot{}, fmt.Errorf("JUDGE_CPU_QUOTA: %w", err)
+		}
+	}
+
+	slots, err := dkrlib.NewSlots(n, cpus, cpusPerSlot, cpuQuota)
+	if err != nil {
+		return nil, dkrlib.Slot{}, err
+	}
+
+	checkerCPUs, err := dkrlib.ParseCPUList(os.Getenv("JUDGE_CHECKER_CPUS"))
+	if err != nil {
+		return nil, dkrlib.Slot{}, fmt.Errorf("JUDGE_CHECKER_CPUS: %w", err)
+	}
+	checkerSlot, err := dkrlib.NewCheckerSlot(slots, checkerCPUs)
+	if err != nil {
+		return nil, dkrlib.Slot{}, fmt.Errorf("JUDGE_CHECKER_CPUS: %w", err)
+	}
+
+	return slots, checkerSlot, nil
+}
+
+// 環境変数からコンテナの隔離の設定を読む
+func newSandboxConfig() (dkrlib.SandboxConfig, error) {
+	var (
+		sandbox dkrlib.SandboxConfig
+		err     error
+	)
+
+	sandbox.NetworkMode = os.Getenv("SANDBOX_NETWORK")
+	sandbox.WorkDir = os.Getenv("SANDBOX_WORKDIR")
+	sandbox.User = os.Getenv("SANDBOX_USER")
+	sandbox.CapDrop = splitList(os.Getenv("SANDBOX_CAP_DROP"))
+	sandbox.CapAdd = splitList(os.Getenv("SANDBOX_CAP_ADD"))
+
+	// "/tmp:rw,exec,size=512m;/run:rw" の形式
+	if tmpfs := os.Getenv("SANDBOX_TMPFS"); tmpfs != "" {
+		sandbox.Tmpfs = make(map[string]string)
+		for _, mount := range strings.Split(tmpfs, ";") {
+			path := strings.SplitN(mount, ":", 2)
+			if len(path) == 2 {
+				sandbox.Tmpfs[path[0]] = path[1]
+			} else {
+				sandbox.Tmpfs[path[0]] = ""
+			}
+		}
+	}
+
+	if readonly := os.Getenv("SANDBOX_READONLY_ROOTFS"); readonly != "" {
+		if sandbox.ReadonlyRootfs, err = strconv.ParseBool(readonly); err != nil {
+			return sandbox, fmt.Errorf("SANDBOX_READONLY_ROOTFS: %w", err)
+		}
+	}
+	if noNewPrivileges := os.Getenv("SANDBOX_NO_NEW_PRIVILEGES"); noNewPrivileges != "" {
+		if sandbox.NoNewPrivileges, err = strconv.ParseBool(noNewPrivileges); err != nil {
+			return sandbox, fmt.Errorf("SANDBOX_NO_NEW_PRIVILEGES: %w", err)
+		}
+	}
+	if fsize := os.Getenv("SANDBOX_FSIZE_LIMIT"); fsize != "" {
+		if sandbox.FileSizeLimit, err = strconv.ParseInt(fsize, 10, 64); err != nil {
+			return sandbox, fmt.Errorf("SANDBOX_FSIZE_LIMIT: %w", err)
+		}
+	}
+	if nofile := os.Getenv("SANDBOX_NOFILE_LIMIT"); nofile != "" {
+		if sandbox.OpenFilesLimit, err = strconv.ParseInt(nofile, 10, 64); err != nil {
+			return sandbox, fmt.Errorf("SANDBOX_NOFILE_LIMIT: %w", err)
+		}
+	}
+
+	if path := os.Getenv("SANDBOX_SECCOMP_PROFILE"); path != "" {
+		profile, err := ioutil.ReadFile(path)
+		if err != nil {
+			return sandbox, fmt.Errorf("SANDBOX_SECCOMP_PROFILE: %w", err)
+		}
+		sandbox.SeccompProfile = string(profile)
+	}
+
+	return sandbox, sandbox.Validate()
+}
+
+// カンマ区切りの値を分ける。空なら nil
+func splitList(str string) []string {
+	if str == "" {
+		return nil
+	}
+
+	list := strings.Split(str, ",")
+	for i := range list {
+		list[i] = strings.TrimSpace(list[i])
+	}
+	return list
+}
+
+// 各言語のイメージを用意し、使えない言語を報告する
+func checkImages(backend dkrlib.Backend) {
+	unavailable := langconf.CheckImages(dkrlib.DefaultImage, func(image string) error {
+		return backend.EnsureImage(context.Background(), image)
+	})
+
+	langIDs := make([]string, 0, len(unavailable))
+	for langID := range unavailable {
+		langIDs = append(langIDs, langID)
+	}
+	sort.Strings(langIDs)
+
+	for _, langID := range langIDs {
+		log.Printf("language %s is unavailable: %s\n", langID, unavailable[langID])
+	}
+}
+
+// SIGHUP を受け取ったら言語設定を読み直し、イメージを用意し直す。ジャッジ中の提出は読み直し前の設定のまま進む。
+func reloadLangConfOnSignal(backend dkrlib.Backend) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	for range sig {
+		diff, err := langconf.Reload(langconf.ConfigPath)
+		if err != nil {
+			log.Printf("language config reload failed, keep current config: %s\n", err)
+			continue
+		}
+
+		log.Printf(
+			"language config reloaded: added=[%s] changed=[%s] removed=[%s]\n",
+			strings.Join(diff.Added, ", "),
+			strings.Join(diff.Changed, ", "),
+			strings.Join(diff.Removed, ", "),
+		)
+		checkImages(backend)
+	}
 }
@@ -1,102 +1,137 @@
 package cmdlib
 
 import (
+	"context"
 	"encoding/base64"
-	"encoding/json"
-	"sync"
-
-	// "errors"
+	"errors"
 	"fmt"
 	"net"
-	"os"
 	"time"
 
 	"github.com/cafecoder-dev/cafecoder-judge/src/types"
 )
 
-type CmdTicket struct {
-	sync.Mutex
-	Channel map[string]chan types.CmdResultJSON
+// コンテナからの応答を待つ時間の上限。実行する要求ではこれに実行時間制限の分を足す
+const responseTimeout = 20 * time.Second
+
+// request の応答を待つ時間。テストケースの実行では、制限を超えて TLE になるまで動くことがあるので
+// 実行時間制限の 2 倍を responseTimeout に足す (コンパイルなど TimeLimit のない要求は responseTimeout だけ)
+func requestTimeout(request types.RequestJSON) time.Duration {
+	return responseTimeout + 2*time.Duration(request.TimeLimit)*time.Millisecond
 }
 
-// ManageCmds ... コンテナからの応答を待つ。
-func ManageCmds(cmdChickets *CmdTicket) {
-	listen, err := net.Listen("tcp", "0.0.0.0:3344")
+// RequestCmd ... コンテナクライアントに接続して要求を 1 つ送り、同じ接続で応答を受け取る。
+// 要求と応答はどちらも token で署名し、署名が正しくない応答は受け付けない。
+// Protocol が ProtocolGRPC なら gRPC で、ProtocolLegacy なら署名のない以前の方式で送る。
+// ctx が終わったら要求を取り消して ctx.Err() を返す。requestTimeout までに応答がなければ Timeout を立てた結果を返す
+func RequestCmd(ctx context.Context, request types.RequestJSON, address string, token string) (types.CmdResultJSON, error) {
+	switch Protocol {
+	case "", ProtocolTCP:
+	case ProtocolGRPC:
+		return requestGRPC(ctx, request, address, token)
+	case ProtocolLegacy:
+		return requestLegacy(ctx, request, address)
+	default:
+		return types.CmdResultJSON{}, fmt.Errorf("unknown protocol %q", Protocol)
+	}
+
+	client, err := Dial(ctx, address, token)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return types.CmdResultJSON{}, err
 	}
+	defer client.Close()
 
-	for {
-		cnct, err := listen.Accept()
-		if err != nil {
-			continue //continue to receive request
+	requestCtx, cancel := context.WithTimeout(ctx, requestTimeout(request))
+	defer cancel()
+
+	recv, err := client.Request(requestCtx, request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return types.CmdResultJSON{}, ctx.Err()
+		}
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+			fmt.Println("Request timed out")
+			return types.CmdResultJSON{
+				SessionID: request.SessionID,
+				Time:      request.TimeLimit,
+				Timeout:   true,
+			}, nil
 		}
-		go func() {
-			var cmdResult types.CmdResultJSON
-			json.NewDecoder(cnct).Decode(&cmdResult)
-			cnct.Close()
-
-			data, _ := base64.StdEncoding.DecodeString(cmdResult.ErrMessage)
-
-			cmdResult.ErrMessage = string(data)
-			go func() {
-				(*cmdChickets).Lock()
-				(*cmdChickets).Channel[cmdResult.SessionID] <- cmdResult
-				(*cmdChickets).Unlock()
-			}()
-		}()
+		return types.CmdResultJSON{}, err
+	}
+
+	if recv.SessionID != request.SessionID {
+		return types.CmdResultJSON{}, fmt.Errorf("session id mismatch: sent %s, received %s", request.SessionID, recv.SessionID)
 	}
+
+	data, err := base64.StdEncoding.DecodeString(recv.ErrMessage)
+	if err != nil {
+		return types.CmdResultJSON{}, err
+	}
+	recv.ErrMessage = string(data)
+
+	return recv, nil
 }
 
-func RequestCmd(request types.RequestJSON, containerIPAddress string, sessionIDChan *chan types.CmdResultJSON) (types.CmdResultJSON, error) {
-	var (
-		recv          types.CmdResultJSON
-		containerConn net.Conn
-		err           error
-	)
-
-	// コンテナへのリクエストが失敗したら再リクエストする。
-	count := 0
-	for {
-		containerConn, err = net.Dial("tcp", containerIPAddress+":8887")
+// Rekey ... コンテナクライアントが署名と認証に使うトークンを token から newToken に変える。Protocol に従って送る
+func Rekey(ctx context.Context, address string, token string, newToken string) error {
+	ctx, cancel := context.WithTimeout(ctx, responseTimeout)
+	defer cancel()
+
+	switch Protocol {
+	case "", ProtocolTCP:
+		client, err := Dial(ctx, address, token)
 		if err != nil {
-			time.Sleep(time.Second)
-			fmt.Println("Request again")
-			count++
-			if count > 10 {
-				return recv, err
-			}
-			continue
+			return err
 		}
+		defer client.Close()
 
-		break
-	}
+		return client.Rekey(newToken, responseTimeout)
+	case ProtocolGRPC:
+		client, err := DialGRPC(ctx, address, token)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
 
-	b, err := json.Marshal(request)
-	if err != nil {
-		return recv, err
+		return client.Rekey(ctx, newToken)
+	case ProtocolLegacy:
+		return ErrUnsupported
+	default:
+		return fmt.Errorf("unknown protocol %q", Protocol)
 	}
+}
 
-	_, err = containerConn.Write(b)
-	if err != nil {
-		return recv, err
-	}
-	containerConn.Close()
+// Ping ... コンテナクライアントが token で署名した要求に応答できるかを確かめる。Protocol に従って送る。
+// ping に対応していない tcp のコンテナクライアントは、ハンドシェイクに応答できれば良しとする。ProtocolLegacy では確かめられない
+func Ping(ctx context.Context, address string, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, responseTimeout)
+	defer cancel()
 
-	timeout := time.After(20 * time.Second)
-	for {
-		select {
-		case <-timeout:
-			fmt.Println("Request timed out")
-			return types.CmdResultJSON{
-				SessionID: request.SessionID,
-				Time:      request.TimeLimit,
-				Timeout:   true,
-			}, nil
-		case recv := <-*sessionIDChan:
-			if recv.SessionID == request.SessionID {
-				return recv, nil
-			}
+	switch Protocol {
+	case "", ProtocolTCP:
+		client, err := Dial(ctx, address, token)
+		if err != nil {
+			return err
 		}
+		defer client.Close()
+
+		if err := client.Ping(responseTimeout); err != nil && !errors.Is(err, ErrUnsupported) {
+			return err
+		}
+		return nil
+	case ProtocolGRPC:
+		client, err := DialGRPC(ctx, address, token)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		return client.Heartbeat(ctx)
+	case ProtocolLegacy:
+		return nil
+	default:
+		return fmt.Errorf("unknown protocol %q", Protocol)
 	}
 }
@@ -0,0 +1,307 @@
+package cmdlib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/agentpb"
+	"github.com/cafecoder-dev/cafecoder-judge/src/types"
+	"github.com/cafecoder-dev/cafecoder-judge/src/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// コンテナクライアントとの通信方式
+const (
+	ProtocolTCP  = "tcp"  // 長さ付きフレームで JSON を送る (protocol.go)
+	ProtocolGRPC = "grpc" // agentpb の gRPC サービス
+)
+
+// Protocol ... RequestCmd が使う通信方式。"" なら ProtocolTCP
+var Protocol = ProtocolTCP
+
+// TokenMetadata ... gRPC の呼び出しでトークンを渡すメタデータのキー
+const TokenMetadata = "x-cafecoder-token"
+
+// gRPC でつながるまで待つ時間
+const grpcDialTimeout = 10 * time.Second
+
+// 打ち切った Compile・Run を取り消すのを待つ時間
+const grpcCancelTimeout = 5 * time.Second
+
+// Compile・Run で受け取る標準出力・標準エラー出力の上限。超えた分は捨てる
+const outputLimit = 64 * 1024 * 1024
+
+// GRPCClient ... gRPC でつないだコンテナクライアント。応答は token で署名されたものだけを受け付ける
+type GRPCClient struct {
+	conn    *grpc.ClientConn
+	agent   agentpb.AgentClient
+	address string
+	token   string
+}
+
+// DialGRPC ... コンテナクライアントに gRPC で接続する。呼び出しにはすべて token を付ける
+func DialGRPC(ctx context.Context, address string, token string) (*GRPCClient, error) {
+	ctx, cancel := context.WithTimeout(ctx, grpcDialTimeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(
+		ctx,
+		address,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithPerRPCCredentials(tokenCredentials(token)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GRPCClient{conn: conn, agent: agentpb.NewAgentClient(conn), address: address, token: token}, nil
+}
+
+// Close ... 接続を閉じる
+func (client *GRPCClient) Close() error {
+	return client.conn.Close()
+}
+
+// Request ... 要求を対応する RPC で送り、結果を TCP のときと同じ形で返す。ErrMessage は base64 にしない。
+// 要求ごとに nonce を決め、それで署名されていない結果は ErrInvalidSignature にする
+func (client *GRPCClient) Request(ctx context.Context, request types.RequestJSON) (types.CmdResultJSON, error) {
+	nonce := util.GenRandomString(nonceLength)
+
+	switch request.Mode {
+	case "download":
+		return client.download(ctx, request, nonce)
+	case "compile":
+		stream, err := client.agent.Compile(ctx, &agentpb.CompileRequest{
+			SessionId: request.SessionID,
+			Cmd:       request.Cmd,
+			Filename:  request.Filename,
+			Nonce:     nonce,
+		})
+		if err != nil {
+			return types.CmdResultJSON{}, err
+		}
+		return client.receiveOutput(stream, request, nonce)
+	case "judge":
+		stream, err := client.agent.Run(ctx, &agentpb.RunRequest{
+			SessionId:     request.SessionID,
+			Cmd:           request.Cmd,
+			Filename:      request.Filename,
+			ProblemId:     request.ProblemID,
+			ProblemUuid:   request.Problem.UUID,
+			TestcaseId:    request.Testcase.TestcaseID,
+			TestcaseName:  request.Testcase.Name,
+			TimeLimitMs:   int32(request.TimeLimit),
+			MemoryLimitMb: int32(request.MemoryLimit),
+			Nonce:         nonce,
+		})
+		if err != nil {
+			return types.CmdResultJSON{}, err
+		}
+		return client.receiveOutput(stream, request, nonce)
+	default:
+		return types.CmdResultJSON{}, fmt.Errorf("unknown request mode %q", request.Mode)
+	}
+}
+
+func (client *GRPCClient) download(ctx context.Context, request types.RequestJSON, nonce string) (types.CmdResultJSON, error) {
+	res, err := client.agent.Download(ctx, &agentpb.DownloadRequest{
+		SessionId: request.SessionID,
+		CodePath:  request.CodePath,
+		Filename:  request.Filename,
+		Nonce:     nonce,
+	})
+	if err != nil {
+		return types.CmdResultJSON{}, err
+	}
+
+	unsigned := proto.Clone(res).(*agentpb.DownloadResponse)
+	unsigned.Signature = ""
+	if err := verifyProto("download", nonce, unsigned, res.GetSignature(), client.token, client.address); err != nil {
+		return types.CmdResultJSON{}, err
+	}
+
+	return types.CmdResultJSON{
+		SessionID:  request.SessionID,
+		Result:     res.GetOk(),
+		ErrMessage: res.GetErrorMessage(),
+		Filename:   request.Filename,
+	}, nil
+}
+
+// Compile・Run のストリームから最後の Result までを受け取る。出力は outputLimit バイトまでしか残さない
+func (client *GRPCClient) receiveOutput(stream interface {
+	Recv() (*agentpb.Output, error)
+}, request types.RequestJSON, nonce string) (types.CmdResultJSON, error) {
+	var output strings.Builder
+	write := func(b []byte) {
+		if remain := outputLimit - output.Len(); len(b) > remain {
+			b = b[:remain]
+		}
+		output.Write(b)
+	}
+
+	for {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			return types.CmdResultJSON{}, fmt.Errorf("stream closed without result")
+		}
+		if err != nil {
+			return types.CmdResultJSON{}, err
+		}
+
+		switch kind := message.GetKind().(type) {
+		case *agentpb.Output_Stdout:
+			write(kind.Stdout)
+		case *agentpb.Output_Stderr:
+			write(kind.Stderr)
+		case *agentpb.Output_Result:
+			unsigned := proto.Clone(kind.Result).(*agentpb.Result)
+			unsigned.Signature = ""
+			if err := verifyProto("result", nonce, unsigned, kind.Result.GetSignature(), client.token, client.address); err != nil {
+				return types.CmdResultJSON{}, err
+			}
+			return resultToJSON(kind.Result, request, output.String()), nil
+		}
+	}
+}
+
+func resultToJSON(result *agentpb.Result, request types.RequestJSON, output string) types.CmdResultJSON {
+	errMessage := result.GetErrorMessage()
+	if errMessage == "" {
+		errMessage = output
+	}
+
+	recv := types.CmdResultJSON{
+		SessionID:  request.SessionID,
+		Time:       int(result.GetTimeMs()),
+		Result:     result.GetOk(),
+		ErrMessage: errMessage,
+		MemUsage:   int(result.GetMemoryKb()),
+		StdoutSize: result.GetStdoutSize(),
+		Status:     result.GetStatus(),
+		Filename:   request.Filename,
+	}
+	if request.Mode == "judge" {
+		recv.TestcaseResults = types.TestcaseResultsGORM{
+			TestcaseID:      request.Testcase.TestcaseID,
+			Status:          result.GetStatus(),
+			ExecutionTime:   int(result.GetTimeMs()),
+			ExecutionMemory: int(result.GetMemoryKb()),
+		}
+	}
+
+	return recv
+}
+
+// Stat ... sessionID の資源の使用量を問い合わせる。署名が合わない応答は ErrInvalidSignature にする
+func (client *GRPCClient) Stat(ctx context.Context, sessionID string) (*agentpb.StatResponse, error) {
+	nonce := util.GenRandomString(nonceLength)
+
+	res, err := client.agent.Stat(ctx, &agentpb.StatRequest{SessionId: sessionID, Nonce: nonce})
+	if err != nil {
+		return nil, err
+	}
+
+	unsigned := proto.Clone(res).(*agentpb.StatResponse)
+	unsigned.Signature = ""
+	if err := verifyProto("stat", nonce, unsigned, res.GetSignature(), client.token, client.address); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Heartbeat ... コンテナクライアントが応答できるかを確かめる
+func (client *GRPCClient) Heartbeat(ctx context.Context) error {
+	stream, err := client.agent.Heartbeat(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.CloseSend()
+
+	sequence := time.Now().UnixNano()
+	if err := stream.Send(&agentpb.HeartbeatRequest{Sequence: sequence}); err != nil {
+		return err
+	}
+	res, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if res.GetSequence() != sequence {
+		return fmt.Errorf("heartbeat sequence mismatch: sent %d, received %d", sequence, res.GetSequence())
+	}
+
+	return nil
+}
+
+// Rekey ... 以降の呼び出しに使うトークンを token に変える。この接続は古いトークンのままなので、使い終わったら閉じること
+func (client *GRPCClient) Rekey(ctx context.Context, token string) error {
+	_, err := client.agent.Rekey(ctx, &agentpb.RekeyRequest{Token: token})
+	return err
+}
+
+// gRPC で要求を送る。ctx が終わったら呼び出しごと取り消し、応答が遅れたときは Timeout を立てた結果を返す。
+// どちらの場合も、コンテナで動き続けないように Cancel で実行を取り消す
+func requestGRPC(ctx context.Context, request types.RequestJSON, address string, token string) (types.CmdResultJSON, error) {
+	client, err := DialGRPC(ctx, address, token)
+	if err != nil {
+		if ctx.Err() != nil {
+			return types.CmdResultJSON{}, ctx.Err()
+		}
+		return types.CmdResultJSON{}, err
+	}
+	defer client.Close()
+
+	requestCtx, cancel := context.WithTimeout(ctx, requestTimeout(request))
+	defer cancel()
+
+	recv, err := client.Request(requestCtx, request)
+	if ctx.Err() != nil {
+		client.cancelSession(request)
+		return types.CmdResultJSON{}, ctx.Err()
+	}
+	if status.Code(err) == codes.DeadlineExceeded {
+		client.cancelSession(request)
+		fmt.Println("Request timed out")
+		return types.CmdResultJSON{
+			SessionID: request.SessionID,
+			Time:      request.TimeLimit,
+			Timeout:   true,
+		}, nil
+	}
+
+	return recv, err
+}
+
+// 打ち切った Compile・Run をコンテナクライアントに取り消させる。もう終わっていれば何もしない
+func (client *GRPCClient) cancelSession(request types.RequestJSON) {
+	if request.Mode != "compile" && request.Mode != "judge" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grpcCancelTimeout)
+	defer cancel()
+
+	if _, err := client.agent.Cancel(ctx, &agentpb.CancelRequest{SessionId: request.SessionID}); err != nil {
+		fmt.Printf("cancel %s: %s\n", request.SessionID, err)
+	}
+}
+
+// 呼び出しごとにトークンをメタデータに付ける
+type tokenCredentials string
+
+func (token tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{TokenMetadata: string(token)}, nil
+}
+
+// トークンは平文の接続でも送る。コンテナとの通信はジャッジ専用のネットワークに閉じている前提
+func (token tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
@@ -0,0 +1,140 @@
+package cmdlib
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/types"
+)
+
+// ProtocolLegacy ... フレームも署名もない以前のプロトコル (バージョン 0)。
+// 要求の JSON を送って接続を閉じ、結果はコンテナクライアントがジャッジの LegacyPort に接続して JSON で返す。
+// 署名がないので、結果は要求を送ったコンテナの IP アドレスから届いたものだけを受け付ける。移行のためだけに使うこと
+const ProtocolLegacy = "legacy"
+
+// LegacyPort ... ProtocolLegacy でコンテナクライアントが結果を返すジャッジのポート
+const LegacyPort = 3344
+
+// 結果を待っている要求。SessionID ごとに 1 つずつ
+var legacyWaiting = struct {
+	sync.Mutex
+	requests map[string]legacyRequest
+}{requests: make(map[string]legacyRequest)}
+
+type legacyRequest struct {
+	host   string // 要求を送ったコンテナの IP アドレス
+	result chan types.CmdResultJSON
+}
+
+// ListenLegacy ... ProtocolLegacy のコンテナクライアントから結果を受け取る。ctx が終わるまで戻らない
+func ListenLegacy(ctx context.Context) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", LegacyPort))
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			continue
+		}
+		go receiveLegacy(conn)
+	}
+}
+
+func receiveLegacy(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(responseTimeout))
+	var recv types.CmdResultJSON
+	if err := json.NewDecoder(conn).Decode(&recv); err != nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+
+	legacyWaiting.Lock()
+	request, exist := legacyWaiting.requests[recv.SessionID]
+	if exist && request.host == host {
+		delete(legacyWaiting.requests, recv.SessionID)
+	}
+	legacyWaiting.Unlock()
+
+	if !exist {
+		return
+	}
+	if request.host != host {
+		securityEvent(host, fmt.Sprintf("legacy result for session %s from another host", recv.SessionID))
+		return
+	}
+	request.result <- recv
+}
+
+// ProtocolLegacy で要求を送る。requestTimeout までに結果が届かなければ Timeout を立てた結果を返す
+func requestLegacy(ctx context.Context, request types.RequestJSON, address string) (types.CmdResultJSON, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return types.CmdResultJSON{}, err
+	}
+
+	waiting := legacyRequest{host: host, result: make(chan types.CmdResultJSON, 1)}
+	legacyWaiting.Lock()
+	legacyWaiting.requests[request.SessionID] = waiting
+	legacyWaiting.Unlock()
+	defer func() {
+		legacyWaiting.Lock()
+		if legacyWaiting.requests[request.SessionID] == waiting {
+			delete(legacyWaiting.requests, request.SessionID)
+		}
+		legacyWaiting.Unlock()
+	}()
+
+	conn, err := dialAgent(ctx, address)
+	if err != nil {
+		return types.CmdResultJSON{}, err
+	}
+	b, err := json.Marshal(request)
+	if err != nil {
+		conn.Close()
+		return types.CmdResultJSON{}, err
+	}
+	_, err = conn.Write(b)
+	conn.Close()
+	if err != nil {
+		return types.CmdResultJSON{}, err
+	}
+
+	select {
+	case recv := <-waiting.result:
+		data, err := base64.StdEncoding.DecodeString(recv.ErrMessage)
+		if err != nil {
+			return types.CmdResultJSON{}, err
+		}
+		recv.ErrMessage = string(data)
+		return recv, nil
+	case <-time.After(requestTimeout(request)):
+		fmt.Fprintln(os.Stdout, "Request timed out")
+		return types.CmdResultJSON{
+			SessionID: request.SessionID,
+			Time:      request.TimeLimit,
+			Timeout:   true,
+		}, nil
+	case <-ctx.Done():
+		return types.CmdResultJSON{}, ctx.Err()
+	}
+}
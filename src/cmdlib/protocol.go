@@ -0,0 +1,407 @@
+package cmdlib
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/types"
+	"github.com/cafecoder-dev/cafecoder-judge/src/util"
+)
+
+// ジャッジとコンテナクライアントの間のプロトコル。
+// 各メッセージ (types.MessageJSON) は 4 バイトのビッグエンディアンの長さを前に付けたフレームで送る。
+// 接続したらまず "hello" を交換してバージョンと機能を決め、以降は要求と応答を同じ接続でやりとりする。
+// バージョン 2 から署名に Nonce を含め、応答には答える要求の Nonce を入れる。
+
+// ProtocolVersion ... このジャッジが話すプロトコルの最新のバージョン
+const ProtocolVersion = 2
+
+// 対応するバージョン。新しいものから順に並べる
+var supportedVersions = []int{ProtocolVersion}
+
+// 機能。hello で両方が対応していると確かめたものだけを使う
+const (
+	CapabilityPing   = "ping"
+	CapabilityCancel = "cancel"
+	CapabilityRekey  = "rekey"
+)
+
+var capabilities = []string{CapabilityPing, CapabilityCancel, CapabilityRekey}
+
+// 要求ごとの Nonce の長さ
+const nonceLength = 32
+
+// フレームの大きさの上限 (バイト)
+const maxFrameSize = 16 * 1024 * 1024
+
+// hello の応答を待つ時間
+const handshakeTimeout = 10 * time.Second
+
+// RemoteError ... コンテナクライアントが返したエラー
+type RemoteError struct {
+	Code    string
+	Message string
+}
+
+func (err *RemoteError) Error() string {
+	return fmt.Sprintf("container error (%s): %s", err.Code, err.Message)
+}
+
+// ErrUnsupported ... コンテナクライアントがその機能に対応していない
+var ErrUnsupported = errors.New("capability is not supported by the container")
+
+// Client ... コンテナクライアントとの 1 本の接続。
+// Request と Ping は同時に呼ばないこと。Cancel は Request の途中に別の goroutine から呼べる
+type Client struct {
+	conn    net.Conn
+	address string
+	token   string
+
+	version      int
+	capabilities map[string]bool
+
+	// 応答をまだ受け取っていない ping の Nonce。遅れて届いた pong はこれと合うものだけを受け付ける
+	pingNonce string
+
+	writeMu sync.Mutex
+}
+
+// Dial ... コンテナクライアントに接続してバージョンと機能を決める。接続できなければ ctx が終わるまでしばらく繰り返す
+func Dial(ctx context.Context, address string, token string) (*Client, error) {
+	conn, err := dialAgent(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{conn: conn, address: address, token: token}
+	if err := client.handshake(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// コンテナクライアントに tcp で接続する。起動直後などで接続できなければ何度か繰り返す
+func dialAgent(ctx context.Context, address string) (net.Conn, error) {
+	var (
+		conn   net.Conn
+		err    error
+		dialer net.Dialer
+	)
+
+	// コンテナへのリクエストが失敗したら再リクエストする。
+	count := 0
+	for {
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			fmt.Println("Request again")
+			count++
+			if count > 10 {
+				return nil, err
+			}
+			continue
+		}
+
+		break
+	}
+
+	return conn, nil
+}
+
+func (client *Client) handshake(ctx context.Context) error {
+	nonce, err := client.send("hello", types.HelloJSON{Versions: supportedVersions, Capabilities: capabilities})
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(handshakeTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	message, err := client.receive(deadline)
+	if err != nil {
+		return err
+	}
+	if err := verifyNonce(message, nonce, client.address); err != nil {
+		return err
+	}
+	if message.Type == "error" {
+		return remoteError(message)
+	}
+	if message.Type != "hello" {
+		return fmt.Errorf("unexpected message %q during handshake", message.Type)
+	}
+
+	var hello types.HelloJSON
+	if err := json.Unmarshal(message.Payload, &hello); err != nil {
+		return err
+	}
+
+	supported := false
+	for _, version := range supportedVersions {
+		supported = supported || version == hello.Version
+	}
+	if !supported {
+		return fmt.Errorf("container chose unsupported protocol version %d", hello.Version)
+	}
+
+	client.version = hello.Version
+	client.capabilities = make(map[string]bool)
+	for _, capability := range hello.Capabilities {
+		client.capabilities[capability] = true
+	}
+
+	return nil
+}
+
+// Close ... 接続を閉じる
+func (client *Client) Close() error {
+	return client.conn.Close()
+}
+
+// Version ... hello で決まったバージョン
+func (client *Client) Version() int {
+	return client.version
+}
+
+// Supports ... hello で両方が対応していると確かめた機能か
+func (client *Client) Supports(capability string) bool {
+	return client.capabilities[capability]
+}
+
+// Request ... 要求を送り、ctx が終わるまでに応答を受け取る。
+// ctx が終わったときは実行中の要求を取り消して接続を閉じ、ctx.Err() を返す。
+// コンテナが処理できなかったときは *RemoteError を返す
+func (client *Client) Request(ctx context.Context, request types.RequestJSON) (types.CmdResultJSON, error) {
+	var recv types.CmdResultJSON
+
+	switch request.Mode {
+	case "download", "compile", "judge":
+	default:
+		return recv, fmt.Errorf("unknown request mode %q", request.Mode)
+	}
+
+	nonce, err := client.send(request.Mode, request)
+	if err != nil {
+		return recv, err
+	}
+
+	// ctx が終わったら、待っている受信を接続ごと打ち切る
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if client.Supports(CapabilityCancel) {
+				_ = client.Cancel(request.SessionID)
+			}
+			client.conn.Close()
+		case <-done:
+		}
+	}()
+
+	deadline, _ := ctx.Deadline()
+	for {
+		message, err := client.receive(deadline)
+		if err != nil {
+			if ctx.Err() != nil {
+				return recv, ctx.Err()
+			}
+			return recv, err
+		}
+
+		switch message.Type {
+		case "result":
+			if err := verifyNonce(message, nonce, client.address); err != nil {
+				return recv, err
+			}
+			if err := json.Unmarshal(message.Payload, &recv); err != nil {
+				return recv, err
+			}
+			return recv, nil
+		case "error":
+			if err := verifyNonce(message, nonce, client.address); err != nil {
+				return recv, err
+			}
+			return recv, remoteError(message)
+		case "pong":
+			// 先に送って待ちきれなかった ping への応答
+			if client.pingNonce == "" {
+				return recv, fmt.Errorf("unexpected message %q", message.Type)
+			}
+			if err := verifyNonce(message, client.pingNonce, client.address); err != nil {
+				return recv, err
+			}
+			client.pingNonce = ""
+		default:
+			return recv, fmt.Errorf("unexpected message %q", message.Type)
+		}
+	}
+}
+
+// Ping ... コンテナクライアントが応答できるかを確かめる
+func (client *Client) Ping(timeout time.Duration) error {
+	if !client.Supports(CapabilityPing) {
+		return ErrUnsupported
+	}
+	nonce, err := client.send("ping", struct{}{})
+	if err != nil {
+		return err
+	}
+	client.pingNonce = nonce
+
+	message, err := client.receive(time.Now().Add(timeout))
+	if err != nil {
+		return err
+	}
+	if err := verifyNonce(message, nonce, client.address); err != nil {
+		return err
+	}
+
+	switch message.Type {
+	case "pong":
+		client.pingNonce = ""
+		return nil
+	case "error":
+		return remoteError(message)
+	default:
+		return fmt.Errorf("unexpected message %q", message.Type)
+	}
+}
+
+// Rekey ... 以降の署名に使うトークンを token に変える。
+// コンテナは古いトークンで署名した要求を受け取り、新しいトークンで署名した "rekeyed" を返す。この接続でもそれ以降は token を使う
+func (client *Client) Rekey(token string, timeout time.Duration) error {
+	if !client.Supports(CapabilityRekey) {
+		return ErrUnsupported
+	}
+	nonce, err := client.send("rekey", types.RekeyJSON{Token: token})
+	if err != nil {
+		return err
+	}
+
+	client.token = token
+	message, err := client.receive(time.Now().Add(timeout))
+	if err != nil {
+		return err
+	}
+	if err := verifyNonce(message, nonce, client.address); err != nil {
+		return err
+	}
+
+	switch message.Type {
+	case "rekeyed":
+		return nil
+	case "error":
+		return remoteError(message)
+	default:
+		return fmt.Errorf("unexpected message %q", message.Type)
+	}
+}
+
+// Cancel ... sessionID の実行中の要求を取り消す。取り消された要求には "canceled" のエラーが返る
+func (client *Client) Cancel(sessionID string) error {
+	if !client.Supports(CapabilityCancel) {
+		return ErrUnsupported
+	}
+
+	_, err := client.send("cancel", types.CancelJSON{SessionID: sessionID})
+	return err
+}
+
+// 新しい Nonce を付けて署名したメッセージを送り、その Nonce を返す
+func (client *Client) send(messageType string, payload interface{}) (string, error) {
+	nonce := util.GenRandomString(nonceLength)
+	message, err := sign(messageType, nonce, payload, client.token)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+
+	return nonce, writeFrame(client.conn, b)
+}
+
+// 次のメッセージを受け取って署名を確かめる
+func (client *Client) receive(deadline time.Time) (types.MessageJSON, error) {
+	var message types.MessageJSON
+
+	if err := client.conn.SetReadDeadline(deadline); err != nil {
+		return message, err
+	}
+	frame, err := readFrame(client.conn)
+	if err != nil {
+		return message, err
+	}
+
+	if err := json.Unmarshal(frame, &message); err != nil {
+		return message, fmt.Errorf("malformed message: %w", err)
+	}
+	if err := verify(message, client.token, client.address); err != nil {
+		return types.MessageJSON{}, err
+	}
+
+	return message, nil
+}
+
+func remoteError(message types.MessageJSON) error {
+	var errJSON types.ErrorJSON
+	if err := json.Unmarshal(message.Payload, &errJSON); err != nil {
+		return fmt.Errorf("malformed error message: %w", err)
+	}
+
+	return &RemoteError{Code: errJSON.Code, Message: errJSON.Message}
+}
+
+func writeFrame(writer io.Writer, payload []byte) error {
+	if len(payload) > maxFrameSize {
+		return fmt.Errorf("frame too large: %d bytes", len(payload))
+	}
+
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+
+	_, err := writer.Write(frame)
+	return err
+}
+
+func readFrame(reader io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("frame too large: %d bytes", size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
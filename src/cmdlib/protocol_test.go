@@ -0,0 +1,355 @@
+package cmdlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/types"
+)
+
+// net.Pipe の向こう側でコンテナクライアントの代わりをする
+type fakeAgent struct {
+	t     *testing.T
+	conn  net.Conn
+	token string
+}
+
+// Client と fakeAgent を net.Pipe でつなぐ。どちらもテストの終わりに閉じる
+func newPipe(t *testing.T, token string) (*Client, *fakeAgent) {
+	judgeConn, agentConn := net.Pipe()
+	t.Cleanup(func() {
+		judgeConn.Close()
+		agentConn.Close()
+	})
+
+	return &Client{conn: judgeConn, address: "pipe", token: token}, &fakeAgent{t: t, conn: agentConn, token: token}
+}
+
+// ジャッジからのメッセージを 1 つ受け取り、署名を確かめる
+func (agent *fakeAgent) receive() types.MessageJSON {
+	var message types.MessageJSON
+
+	_ = agent.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frame, err := readFrame(agent.conn)
+	if err != nil {
+		agent.t.Errorf("agent: read frame: %v", err)
+		return message
+	}
+	if err := json.Unmarshal(frame, &message); err != nil {
+		agent.t.Errorf("agent: malformed message: %v", err)
+		return message
+	}
+	if err := verify(message, agent.token, "judge"); err != nil {
+		agent.t.Errorf("agent: %s: %v", message.Type, err)
+	}
+
+	return message
+}
+
+// token で署名したメッセージを送る
+func (agent *fakeAgent) sendSigned(messageType string, nonce string, payload interface{}, token string) {
+	message, err := sign(messageType, nonce, payload, token)
+	if err != nil {
+		agent.t.Errorf("agent: sign: %v", err)
+		return
+	}
+	b, err := json.Marshal(message)
+	if err != nil {
+		agent.t.Errorf("agent: marshal: %v", err)
+		return
+	}
+	if err := writeFrame(agent.conn, b); err != nil {
+		agent.t.Errorf("agent: write frame: %v", err)
+	}
+}
+
+func (agent *fakeAgent) send(messageType string, nonce string, payload interface{}) {
+	agent.sendSigned(messageType, nonce, payload, agent.token)
+}
+
+// hello に答えて version を選ぶ
+func (agent *fakeAgent) hello(version int) {
+	hello := agent.receive()
+	if hello.Type != "hello" {
+		agent.t.Errorf("agent: got %q, want hello", hello.Type)
+	}
+	agent.send("hello", hello.Nonce, types.HelloJSON{Version: version, Capabilities: capabilities})
+}
+
+// agent を別の goroutine で動かし、終わるのを待つ関数を返す
+func runAgent(agent func()) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		agent()
+	}()
+
+	return func() { <-done }
+}
+
+func judgeRequest() types.RequestJSON {
+	return types.RequestJSON{Mode: "judge", SessionID: "1", Cmd: "./a.out", TimeLimit: 1000}
+}
+
+func TestRequest(t *testing.T) {
+	client, agent := newPipe(t, "token")
+	wait := runAgent(func() {
+		agent.hello(ProtocolVersion)
+		request := agent.receive()
+		agent.send("result", request.Nonce, types.CmdResultJSON{SessionID: "1", Result: true, Status: "AC"})
+	})
+	defer wait()
+
+	if err := client.handshake(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	recv, err := client.Request(context.Background(), judgeRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !recv.Result || recv.Status != "AC" {
+		t.Errorf("Request() = %+v, want an AC result", recv)
+	}
+}
+
+func TestRequestRejectsBadSignature(t *testing.T) {
+	client, agent := newPipe(t, "token")
+	wait := runAgent(func() {
+		agent.hello(ProtocolVersion)
+		request := agent.receive()
+		agent.sendSigned("result", request.Nonce, types.CmdResultJSON{SessionID: "1", Result: true, Status: "AC"}, "forged")
+	})
+	defer wait()
+
+	if err := client.handshake(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Request(context.Background(), judgeRequest()); err != ErrInvalidSignature {
+		t.Errorf("Request() error = %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestRequestRejectsReplayedNonce(t *testing.T) {
+	tests := []struct {
+		name  string
+		nonce func(hello string, request string) string
+	}{
+		{name: "nonce of an earlier message", nonce: func(hello string, request string) string { return hello }},
+		{name: "other nonce", nonce: func(hello string, request string) string { return "other" }},
+		{name: "empty nonce", nonce: func(hello string, request string) string { return "" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, agent := newPipe(t, "token")
+			wait := runAgent(func() {
+				hello := agent.receive()
+				agent.send("hello", hello.Nonce, types.HelloJSON{Version: ProtocolVersion, Capabilities: capabilities})
+				request := agent.receive()
+				agent.send("result", tt.nonce(hello.Nonce, request.Nonce), types.CmdResultJSON{SessionID: "1", Result: true, Status: "AC"})
+			})
+			defer wait()
+
+			if err := client.handshake(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := client.Request(context.Background(), judgeRequest()); err != ErrInvalidSignature {
+				t.Errorf("Request() error = %v, want ErrInvalidSignature", err)
+			}
+		})
+	}
+}
+
+func TestHandshakeRejectsMismatchedNonce(t *testing.T) {
+	client, agent := newPipe(t, "token")
+	wait := runAgent(func() {
+		agent.receive()
+		agent.send("hello", "other", types.HelloJSON{Version: ProtocolVersion, Capabilities: capabilities})
+	})
+	defer wait()
+
+	if err := client.handshake(context.Background()); err != ErrInvalidSignature {
+		t.Errorf("handshake() error = %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	client, agent := newPipe(t, "old")
+	wait := runAgent(func() {
+		agent.hello(ProtocolVersion)
+
+		// rekey は古いトークンで署名されて届き、新しいトークンで答える
+		rekey := agent.receive()
+		var payload types.RekeyJSON
+		if err := json.Unmarshal(rekey.Payload, &payload); err != nil {
+			t.Errorf("agent: malformed rekey: %v", err)
+		}
+		agent.token = payload.Token
+		agent.send("rekeyed", rekey.Nonce, struct{}{})
+
+		// 以降の要求も新しいトークンで署名されている
+		request := agent.receive()
+		agent.send("result", request.Nonce, types.CmdResultJSON{SessionID: "1", Result: true, Status: "AC"})
+	})
+	defer wait()
+
+	if err := client.handshake(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rekey("new", 5*time.Second); err != nil {
+		t.Fatalf("Rekey() error = %v", err)
+	}
+	if client.token != "new" {
+		t.Errorf("token after Rekey() = %q, want %q", client.token, "new")
+	}
+	if _, err := client.Request(context.Background(), judgeRequest()); err != nil {
+		t.Errorf("Request() after Rekey() error = %v", err)
+	}
+}
+
+func TestRekeyRejectsOldToken(t *testing.T) {
+	client, agent := newPipe(t, "old")
+	wait := runAgent(func() {
+		agent.hello(ProtocolVersion)
+		rekey := agent.receive()
+		// 新しいトークンを知らない相手は古いトークンでしか署名できない
+		agent.send("rekeyed", rekey.Nonce, struct{}{})
+	})
+	defer wait()
+
+	if err := client.handshake(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rekey("new", 5*time.Second); err != ErrInvalidSignature {
+		t.Errorf("Rekey() error = %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readFrame(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "payload" {
+		t.Errorf("readFrame() = %q, want %q", got, "payload")
+	}
+
+	if err := writeFrame(&buf, make([]byte, maxFrameSize+1)); err == nil {
+		t.Error("writeFrame() with a frame over maxFrameSize succeeded")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("writeFrame() wrote %d bytes of a refused frame", buf.Len())
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], maxFrameSize+1)
+	if _, err := readFrame(bytes.NewReader(header[:])); err == nil {
+		t.Error("readFrame() with a header over maxFrameSize succeeded")
+	}
+}
+
+func TestReceiveRejectsLargeFrame(t *testing.T) {
+	client, agent := newPipe(t, "token")
+	wait := runAgent(func() {
+		agent.receive()
+		// 中身は送らず、長さだけで拒まれることを確かめる
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], maxFrameSize+1)
+		if _, err := agent.conn.Write(header[:]); err != nil {
+			t.Errorf("agent: write header: %v", err)
+		}
+	})
+	defer wait()
+
+	if err := client.handshake(context.Background()); err == nil {
+		t.Error("handshake() with a frame over maxFrameSize succeeded")
+	}
+}
+
+func TestHandshakeVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		wantErr bool
+	}{
+		{name: "supported", version: ProtocolVersion},
+		{name: "older", version: 1, wantErr: true},
+		{name: "newer", version: ProtocolVersion + 1, wantErr: true},
+		{name: "missing", version: 0, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, agent := newPipe(t, "token")
+			wait := runAgent(func() { agent.hello(tt.version) })
+			defer wait()
+
+			err := client.handshake(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("handshake() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && client.Version() != tt.version {
+				t.Errorf("Version() = %d, want %d", client.Version(), tt.version)
+			}
+		})
+	}
+}
+
+func TestRequestPong(t *testing.T) {
+	tests := []struct {
+		name    string
+		ping    bool
+		nonce   func(ping string) string
+		wantErr bool
+	}{
+		{name: "late pong", ping: true, nonce: func(ping string) string { return ping }},
+		{name: "pong with another nonce", ping: true, nonce: func(ping string) string { return "other" }, wantErr: true},
+		{name: "pong without ping", nonce: func(ping string) string { return "" }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, agent := newPipe(t, "token")
+			pinged := make(chan struct{})
+			wait := runAgent(func() {
+				agent.hello(ProtocolVersion)
+				var ping types.MessageJSON
+				if tt.ping {
+					// Ping が諦めるまで pong を返さない
+					ping = agent.receive()
+					<-pinged
+				}
+				request := agent.receive()
+				agent.send("pong", tt.nonce(ping.Nonce), struct{}{})
+				if !tt.wantErr {
+					agent.send("result", request.Nonce, types.CmdResultJSON{SessionID: "1", Result: true, Status: "AC"})
+				}
+			})
+			defer wait()
+
+			if err := client.handshake(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if tt.ping {
+				if err := client.Ping(10 * time.Millisecond); err == nil {
+					t.Fatal("Ping() without pong succeeded")
+				}
+				close(pinged)
+			}
+
+			_, err := client.Request(context.Background(), judgeRequest())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Request() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
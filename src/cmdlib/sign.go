@@ -0,0 +1,88 @@
+package cmdlib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrInvalidSignature ... コンテナからのメッセージに署名がないか、署名が一致しない
+var ErrInvalidSignature = errors.New("invalid message signature")
+
+// sign ... payload をトークンで署名したメッセージを作る
+func sign(messageType string, nonce string, payload interface{}, token string) (types.MessageJSON, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return types.MessageJSON{}, err
+	}
+
+	return types.MessageJSON{Type: messageType, Nonce: nonce, Payload: b, Signature: signature(messageType, nonce, b, token)}, nil
+}
+
+// verify ... メッセージの署名を確かめる。
+// 署名がおかしければセキュリティイベントとして記録し、ErrInvalidSignature を返す
+func verify(message types.MessageJSON, token string, address string) error {
+	if message.Signature == "" {
+		securityEvent(address, "unsigned message")
+		return ErrInvalidSignature
+	}
+
+	expected, err := hex.DecodeString(signature(message.Type, message.Nonce, message.Payload, token))
+	if err != nil {
+		return err
+	}
+	actual, err := hex.DecodeString(message.Signature)
+	if err != nil || !hmac.Equal(expected, actual) {
+		securityEvent(address, "signature mismatch")
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// verifyProto ... gRPC の応答 message の署名 sig を確かめる。message は signature を空にしたものを渡すこと。
+// payload は message を決定的に直列化したもの
+func verifyProto(messageType string, nonce string, message proto.Message, sig string, token string, address string) error {
+	payload, err := proto.MarshalOptions{Deterministic: true}.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	return verify(types.MessageJSON{Type: messageType, Nonce: nonce, Payload: payload, Signature: sig}, token, address)
+}
+
+// verifyNonce ... 応答が nonce の要求に答えたものかを確かめる。
+// 別の要求への応答を使い回したものならセキュリティイベントとして記録し、ErrInvalidSignature を返す
+func verifyNonce(message types.MessageJSON, nonce string, address string) error {
+	if !hmac.Equal([]byte(message.Nonce), []byte(nonce)) {
+		securityEvent(address, "nonce mismatch")
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// 種類を入れ替えても同じ署名にならないように、Type と Nonce と Payload を 0 バイトで区切って署名する
+func signature(messageType string, nonce string, payload []byte, token string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	_, _ = mac.Write([]byte(messageType))
+	_, _ = mac.Write([]byte{0})
+	_, _ = mac.Write([]byte(nonce))
+	_, _ = mac.Write([]byte{0})
+	_, _ = mac.Write(payload)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 改ざんやなりすましが疑われるメッセージを記録する
+func securityEvent(address string, reason string) {
+	fmt.Fprintf(os.Stderr, "[security] %s rejected message from %s: %s\n", time.Now().Format(time.RFC3339), address, reason)
+}
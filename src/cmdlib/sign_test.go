@@ -0,0 +1,89 @@
+package cmdlib
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/agentpb"
+	"github.com/cafecoder-dev/cafecoder-judge/src/types"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestVerify(t *testing.T) {
+	const token = "token"
+
+	valid, err := sign("result", "nonce", types.CmdResultJSON{SessionID: "1", Result: true}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(message *types.MessageJSON)
+		token   string
+		wantErr bool
+	}{
+		{name: "valid", modify: func(message *types.MessageJSON) {}, token: token},
+		{name: "other token", modify: func(message *types.MessageJSON) {}, token: "other", wantErr: true},
+		{name: "unsigned", modify: func(message *types.MessageJSON) { message.Signature = "" }, token: token, wantErr: true},
+		{name: "not hex", modify: func(message *types.MessageJSON) { message.Signature = "zz" }, token: token, wantErr: true},
+		{name: "changed type", modify: func(message *types.MessageJSON) { message.Type = "pong" }, token: token, wantErr: true},
+		{name: "changed nonce", modify: func(message *types.MessageJSON) { message.Nonce = "other" }, token: token, wantErr: true},
+		{name: "changed payload", modify: func(message *types.MessageJSON) {
+			message.Payload = json.RawMessage(`{"sessionID":"2","result":true}`)
+		}, token: token, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := valid
+			tt.modify(&message)
+
+			err := verify(message, tt.token, "test")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && err != ErrInvalidSignature {
+				t.Errorf("verify() error = %v, want ErrInvalidSignature", err)
+			}
+		})
+	}
+}
+
+func TestVerifyNonce(t *testing.T) {
+	message := types.MessageJSON{Type: "result", Nonce: "nonce"}
+
+	if err := verifyNonce(message, "nonce", "test"); err != nil {
+		t.Errorf("verifyNonce() with the same nonce error = %v", err)
+	}
+	if err := verifyNonce(message, "other", "test"); err != ErrInvalidSignature {
+		t.Errorf("verifyNonce() with another nonce error = %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestVerifyProto(t *testing.T) {
+	const token = "token"
+
+	result := &agentpb.Result{Ok: true, Status: "AC", TimeMs: 10}
+	payload, err := proto.MarshalOptions{Deterministic: true}.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := signature("result", "nonce", payload, token)
+
+	if err := verifyProto("result", "nonce", result, sig, token, "test"); err != nil {
+		t.Errorf("verifyProto() error = %v", err)
+	}
+	if err := verifyProto("download", "nonce", result, sig, token, "test"); err != ErrInvalidSignature {
+		t.Errorf("verifyProto() with another type error = %v, want ErrInvalidSignature", err)
+	}
+	if err := verifyProto("result", "other", result, sig, token, "test"); err != ErrInvalidSignature {
+		t.Errorf("verifyProto() with another nonce error = %v, want ErrInvalidSignature", err)
+	}
+
+	tampered := proto.Clone(result).(*agentpb.Result)
+	tampered.Status = "WA"
+	if err := verifyProto("result", "nonce", tampered, sig, token, "test"); err != ErrInvalidSignature {
+		t.Errorf("verifyProto() with a tampered result error = %v, want ErrInvalidSignature", err)
+	}
+}
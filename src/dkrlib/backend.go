@@ -0,0 +1,106 @@
+package dkrlib
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// AgentPort ... コンテナクライアントがジャッジからの要求を待ち受けるポート
+const AgentPort = 8887
+
+// Sandbox ごとのトークンは、提出の環境変数などから読まれないようにコンテナクライアントの標準入力の 1 行目で渡す
+
+// トークンの長さ
+const tokenLength = 64
+
+// Sandbox ... 提出を動かす隔離環境。中ではコンテナクライアントが動いていて、Address で要求を受け付ける
+type Sandbox interface {
+	ID() string
+	Image() string
+	Address() string       // コンテナクライアントに接続するアドレス ("host:port")
+	Token() string         // Sandbox を作るときに決めた、メッセージの署名に使う鍵
+	SetToken(token string) // コンテナクライアントのトークンを変えたあとに新しいトークンを覚える
+	WorkDir() string       // ジャッジとコンテナクライアントがファイルを置く作業ディレクトリ
+
+	// 以下のパスは相対パスなら WorkDir からのパス
+	CopyIn(ctx context.Context, content []byte, path string, mode int64) error             // content を path のファイルとして書き込む
+	CopyFilesIn(ctx context.Context, dir string, files []File) error                       // files を dir 以下に書き込む
+	CopyOut(ctx context.Context, path string) (io.ReadCloser, error)                       // path のファイルを読む。なければ os.ErrNotExist を包んだエラー。使い終わったら Close すること
+	CopyDirOut(ctx context.Context, dir string, maxBytes int64) (map[string][]byte, error) // dir 以下のファイルを読む。合計が maxBytes バイトを超えていれば ErrSizeLimit
+	Exec(ctx context.Context, cmd []string) (*ExecResult, error)                           // WorkDir でコマンドを実行する
+
+	// Run ... cmd を WorkDir で実行し、そのプロセスとその子孫だけが使った資源を、実行ごとに作る子 cgroup で測る。
+	// 終わったら残ったプロセスも殺す。測れない環境では ErrMeterUnsupported
+	Run(ctx context.Context, cmd []string, options RunOptions) (*RunResult, error)
+
+	Update(ctx context.Context, memoryLimit int, slot Slot) error // メモリ制限 (MiB) と CPU を設定し直す
+	Stats(ctx context.Context) (*Stats, error)                    // 動いているかとプロセスの数を返す。資源の使用量は Run で測る
+	Destroy(ctx context.Context) error
+}
+
+// Stats ... Sandbox の状態
+type Stats struct {
+	Running   bool
+	Processes int // Sandbox で動いているプロセスの数 (コンテナクライアントを含む)
+}
+
+// ErrMeterUnsupported ... この環境ではホスト側で資源の使用量を測れない
+var ErrMeterUnsupported = errors.New("resource meter is not supported")
+
+// RunOptions ... Run の入出力と制限
+type RunOptions struct {
+	Stdin   io.Reader     // nil なら空。Run から戻ったあとも読まれることがあるので、使い終わったら閉じること
+	Stdout  io.Writer     // nil なら捨てる
+	Stderr  io.Writer     // nil なら捨てる
+	Timeout time.Duration // 実時間の上限。0 なら ctx が終わるまで
+}
+
+// RunResult ... Run の結果
+type RunResult struct {
+	ExitCode  int
+	Usage     Usage
+	OOMKilled bool // メモリ不足で殺された
+	TimedOut  bool // Timeout を超えたので殺した
+}
+
+// Usage ... Run で測った資源の使用量
+type Usage struct {
+	MemoryPeak int64 // バイト
+	CPUTime    time.Duration
+}
+
+// Backend ... Sandbox を作る
+type Backend interface {
+	EnsureImage(ctx context.Context, image string) error // image を使えるようにする。使えなければエラー
+	Create(ctx context.Context, image string, memoryLimit int, slot Slot) (Sandbox, error)
+}
+
+// ErrSizeLimit ... 読もうとしたファイルが大きさの上限を超えている
+var ErrSizeLimit = errors.New("file size limit exceeded")
+
+// ReadFile ... Sandbox 内のファイルを全部読む。maxBytes バイトを超えていれば ErrSizeLimit を返す
+func ReadFile(ctx context.Context, sandbox Sandbox, path string, maxBytes int64) ([]byte, error) {
+	reader, err := sandbox.CopyOut(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return readLimited(reader, maxBytes)
+}
+
+// maxBytes バイトを超えない範囲で reader を最後まで読む
+func readLimited(reader io.Reader, maxBytes int64) ([]byte, error) {
+	content, err := ioutil.ReadAll(io.LimitReader(reader, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > maxBytes {
+		return nil, ErrSizeLimit
+	}
+
+	return content, nil
+}
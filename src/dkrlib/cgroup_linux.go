@@ -0,0 +1,337 @@
+package dkrlib
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/util"
+)
+
+// cgroup ファイルシステムのマウント先
+const cgroupRoot = "/sys/fs/cgroup"
+
+// v2 で Run のあいだ Sandbox のプロセスを移しておく子 cgroup の名前
+const cgroupAgentName = "agent"
+
+// Sandbox の cgroup。Run のたびにこの下に子 cgroup を作って、実行したプロセスだけを測る
+type cgroupParent struct {
+	memoryDir string
+	cpuDir    string
+	v2        bool
+}
+
+// pid のプロセスが属する cgroup を返す。ホストの pid で指定すること
+func pidCgroup(pid int) (cgroupParent, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if os.IsNotExist(err) {
+		// ジャッジ自身がコンテナ内で動いているなどでホストのプロセスが見えない
+		return cgroupParent{}, ErrMeterUnsupported
+	}
+	if err != nil {
+		return cgroupParent{}, err
+	}
+
+	// "hierarchy-ID:controller-list:cgroup-path" の行が並ぶ。v2 は "0::path" の 1 行
+	var memoryDir, cpuDir, unifiedDir string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		for _, controller := range strings.Split(fields[1], ",") {
+			switch controller {
+			case "memory":
+				memoryDir = filepath.Join(cgroupRoot, "memory", fields[2])
+			case "cpuacct":
+				cpuDir = filepath.Join(cgroupRoot, "cpuacct", fields[2])
+			}
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			unifiedDir = filepath.Join(cgroupRoot, fields[2])
+		}
+	}
+
+	switch {
+	case memoryDir != "" && cpuDir != "":
+		return cgroupParent{memoryDir: memoryDir, cpuDir: cpuDir}, nil
+	case unifiedDir != "":
+		// Sandbox の中で子 cgroup に移されたプロセス (Run の途中など) なら、Sandbox の cgroup に戻す
+		if base := filepath.Base(unifiedDir); base == cgroupAgentName || strings.HasPrefix(base, "run-") {
+			unifiedDir = filepath.Dir(unifiedDir)
+		}
+		return cgroupParent{memoryDir: unifiedDir, cpuDir: unifiedDir, v2: true}, nil
+	default:
+		return cgroupParent{}, ErrMeterUnsupported
+	}
+}
+
+// 同じ Sandbox の Run は cgroup を組み替えるので 1 つずつ行う
+var cgroupLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: make(map[string]*sync.Mutex)}
+
+func (parent cgroupParent) lock() *sync.Mutex {
+	cgroupLocks.Lock()
+	defer cgroupLocks.Unlock()
+
+	if _, exist := cgroupLocks.locks[parent.memoryDir]; !exist {
+		cgroupLocks.locks[parent.memoryDir] = &sync.Mutex{}
+	}
+
+	return cgroupLocks.locks[parent.memoryDir]
+}
+
+// newRun ... 1 回の実行のための子 cgroup を作る。使い終わったら remove すること。
+// v2 ではプロセスのいる cgroup の子で memory を使えないので、Sandbox のプロセスを子 cgroup の agent に移してから作る。
+// そのあいだ Sandbox の cgroup に直接プロセスを入れる (docker exec など) ことはできない
+func (parent cgroupParent) newRun() (*runCgroup, error) {
+	name := "run-" + util.GenRandomString(16)
+	run := &runCgroup{
+		parent:    parent,
+		memoryDir: filepath.Join(parent.memoryDir, name),
+		cpuDir:    filepath.Join(parent.cpuDir, name),
+		lock:      parent.lock(),
+	}
+	run.lock.Lock()
+
+	if parent.v2 {
+		if err := parent.delegate(); err != nil {
+			parent.undelegate()
+			run.lock.Unlock()
+			return nil, err
+		}
+	}
+
+	if err := os.Mkdir(run.memoryDir, 0755); err != nil {
+		run.remove()
+		return nil, err
+	}
+	if run.cpuDir != run.memoryDir {
+		if err := os.Mkdir(run.cpuDir, 0755); err != nil {
+			run.remove()
+			return nil, err
+		}
+	}
+
+	// memory.peak は Linux 5.19 から。なければ実行したプロセスだけの最大値は測れない
+	if parent.v2 {
+		if _, err := os.Stat(filepath.Join(run.memoryDir, "memory.peak")); err != nil {
+			run.remove()
+			return nil, ErrMeterUnsupported
+		}
+	}
+
+	return run, nil
+}
+
+// v2 で子 cgroup に memory を使えるようにする
+func (parent cgroupParent) delegate() error {
+	agent := filepath.Join(parent.memoryDir, cgroupAgentName)
+	if err := os.Mkdir(agent, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	// 移しているあいだに fork されたプロセスが残っていると EBUSY になるので、何度か試す
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = moveProcs(parent.memoryDir, agent); err != nil {
+			return err
+		}
+		err = writeCgroupFile(parent.memoryDir, "cgroup.subtree_control", "+memory")
+		if !errors.Is(err, syscall.EBUSY) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// delegate で変えた cgroup を元に戻す。docker exec は Sandbox の cgroup にプロセスを入れるため
+func (parent cgroupParent) undelegate() {
+	agent := filepath.Join(parent.memoryDir, cgroupAgentName)
+	_ = writeCgroupFile(parent.memoryDir, "cgroup.subtree_control", "-memory")
+	_ = moveProcs(agent, parent.memoryDir)
+	_ = os.Remove(agent)
+}
+
+// from のプロセスをすべて to に移す。途中でいなくなったプロセスは無視する
+func moveProcs(from string, to string) error {
+	procs, err := ioutil.ReadFile(filepath.Join(from, "cgroup.procs"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, pid := range strings.Fields(string(procs)) {
+		if err := writeCgroupFile(to, "cgroup.procs", pid); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 1 回の実行のための子 cgroup。v1 では memory と cpuacct の階層にそれぞれ作る
+type runCgroup struct {
+	parent    cgroupParent
+	memoryDir string
+	cpuDir    string
+	lock      *sync.Mutex // remove するまで持つ
+}
+
+// add ... pid のプロセスを入れる。これ以降に使った資源だけが測られる
+func (run *runCgroup) add(pid int) error {
+	for _, dir := range run.dirs() {
+		if err := writeCgroupFile(dir, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (run *runCgroup) dirs() []string {
+	if run.cpuDir == run.memoryDir {
+		return []string{run.memoryDir}
+	}
+
+	return []string{run.memoryDir, run.cpuDir}
+}
+
+// usage ... 入れたプロセスが使った CPU 時間とメモリ使用量の最大値、メモリ不足で殺されたかを返す
+func (run *runCgroup) usage() (Usage, bool, error) {
+	var (
+		usage Usage
+		err   error
+	)
+
+	if run.parent.v2 {
+		usage.MemoryPeak, err = readCgroupInt(run.memoryDir, "memory.peak")
+	} else {
+		usage.MemoryPeak, err = readCgroupInt(run.memoryDir, "memory.max_usage_in_bytes")
+	}
+	if err != nil {
+		return usage, false, err
+	}
+
+	if run.parent.v2 {
+		usage.CPUTime, err = readCPUStat(run.cpuDir)
+	} else {
+		var nanoseconds int64
+		nanoseconds, err = readCgroupInt(run.cpuDir, "cpuacct.usage")
+		usage.CPUTime = time.Duration(nanoseconds)
+	}
+	if err != nil {
+		return usage, false, err
+	}
+
+	// v2 は memory.events、v1 は memory.oom_control の oom_kill。v1 で数えるのは Linux 4.13 から
+	events := "memory.events"
+	if !run.parent.v2 {
+		events = "memory.oom_control"
+	}
+	oomKill, err := readCgroupKey(run.memoryDir, events, "oom_kill")
+	if err != nil {
+		oomKill = 0
+	}
+
+	return usage, oomKill > 0, nil
+}
+
+// kill ... 入れたプロセスと、その子孫で残っているものをすべて殺す。cgroup.kill は Linux 5.14 から
+func (run *runCgroup) kill() {
+	if run.parent.v2 {
+		if err := writeCgroupFile(run.memoryDir, "cgroup.kill", "1"); err == nil {
+			return
+		}
+	}
+
+	// 殺しているあいだに fork されることがあるので、いなくなるまで繰り返す
+	for i := 0; i < 100; i++ {
+		procs, err := ioutil.ReadFile(filepath.Join(run.memoryDir, "cgroup.procs"))
+		if err != nil || len(bytes.TrimSpace(procs)) == 0 {
+			return
+		}
+		for _, pid := range strings.Fields(string(procs)) {
+			if pid, err := strconv.Atoi(pid); err == nil {
+				_ = syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// remove ... プロセスを殺して子 cgroup を消し、v2 なら Sandbox の cgroup を元に戻す
+func (run *runCgroup) remove() {
+	run.kill()
+
+	// 殺したプロセスが終わるまで cgroup は消せない
+	for _, dir := range run.dirs() {
+		for i := 0; i < 100; i++ {
+			if err := os.Remove(dir); err == nil || os.IsNotExist(err) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if run.parent.v2 {
+		run.parent.undelegate()
+	}
+	run.lock.Unlock()
+}
+
+// cgroup v2 の cpu.stat から使った CPU 時間を読む
+func readCPUStat(cgroup string) (time.Duration, error) {
+	usec, err := readCgroupKey(cgroup, "cpu.stat", "usage_usec")
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// "key value" の行が並ぶファイルから key の値を読む
+func readCgroupKey(cgroup string, name string, key string) (int64, error) {
+	content, err := ioutil.ReadFile(filepath.Join(cgroup, name))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			return strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+
+	return 0, fmt.Errorf("%s not found in %s/%s", key, cgroup, name)
+}
+
+func writeCgroupFile(cgroup string, name string, value string) error {
+	return ioutil.WriteFile(filepath.Join(cgroup, name), []byte(value), 0644)
+}
+
+func readCgroupInt(cgroup string, name string) (int64, error) {
+	content, err := ioutil.ReadFile(filepath.Join(cgroup, name))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(string(bytes.TrimSpace(content)), 10, 64)
+}
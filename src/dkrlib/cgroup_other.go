@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package dkrlib
+
+// Linux 以外では cgroup が無いので測れない
+type cgroupParent struct{}
+
+func pidCgroup(pid int) (cgroupParent, error) {
+	return cgroupParent{}, ErrMeterUnsupported
+}
+
+func (parent cgroupParent) newRun() (*runCgroup, error) {
+	return nil, ErrMeterUnsupported
+}
+
+type runCgroup struct{}
+
+func (run *runCgroup) add(pid int) error {
+	return ErrMeterUnsupported
+}
+
+func (run *runCgroup) usage() (Usage, bool, error) {
+	return Usage{}, false, ErrMeterUnsupported
+}
+
+func (run *runCgroup) kill() {}
+
+func (run *runCgroup) remove() {}
@@ -6,105 +6,256 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/util"
 )
 
+// DockerBackend の APIVersion を指定しなかったときに使う docker API のバージョン
 const apiVersion = "1.40"
 
+// DefaultMemoryLimit ... メモリ制限の既定値 (MiB)
+const DefaultMemoryLimit = 2048
+
+// DefaultImage ... ジャッジに使うコンテナのイメージ
+const DefaultImage = "cafecoder"
+
 type Container struct {
 	Client    *client.Client
 	Name      string
 	ID        string
 	IPAddress string
+	Image     string
+	Token     string // コンテナクライアントとのメッセージの署名に使う鍵
+	WorkDir   string // 相対パスの起点とコマンドを実行するディレクトリ。空なら "/"
+
+	uses int // Pool から貸し出された回数
 }
 
 // CreateContainer ... create new container and return container information
-func CreateContainer(ctx context.Context, containerName string) (*Container, error) {
+//
+// memoryLimit はコンテナのメモリ制限 (MiB)
+func CreateContainer(ctx context.Context, containerName string, memoryLimit int) (*Container, error) {
+	return DockerBackend{}.createContainer(ctx, DefaultImage, containerName, memoryLimit, Slot{})
+}
+
+// メモリ制限 (MiB) を docker の Resources に変換する。
+// スワップに逃がすと memory.peak が制限を超えず MLE にならないので、スワップは使わせない (MemorySwap はメモリとスワップの合計)
+func memoryResources(resources *container.Resources, memoryLimit int) {
+	resources.Memory = int64(memoryLimit) * 1024 * 1024
+	resources.MemorySwap = resources.Memory
+}
+
+func (backend DockerBackend) createContainer(ctx context.Context, image string, containerName string, memoryLimit int, slot Slot) (*Container, error) {
 	var err error
 	pidsLimit := int64(1024)
 
-	cli, err := client.NewClientWithOpts(client.WithVersion(apiVersion))
+	if err := backend.Sandbox.Validate(); err != nil {
+		return nil, err
+	}
+
+	cli, err := backend.client()
 	if err != nil {
 		return nil, err
 	}
 	defer cli.Close()
 
-	config := &container.Config{Image: "cafecoder"}
+	token := util.GenRandomString(tokenLength)
+	config := &container.Config{
+		Image:     image,
+		OpenStdin: true,
+		StdinOnce: true,
+	}
 	hostConfig := &container.HostConfig{
 		Resources: container.Resources{
-			Memory:    2048000000, // メモリの制限: 2048 MB
 			PidsLimit: &pidsLimit,
 		},
 	}
+	memoryResources(&hostConfig.Resources, memoryLimit)
+	slot.apply(&hostConfig.Resources)
+	backend.Sandbox.apply(config, hostConfig)
 
 	resp, err := cli.ContainerCreate(ctx, config, hostConfig, nil, nil, containerName)
 	if err != nil {
 		return nil, err
 	}
 
+	// トークンを標準入力で渡す。StdinOnce なので書き終えて切断すると標準入力が閉じる
+	attach, err := cli.ContainerAttach(ctx, resp.ID, types.ContainerAttachOptions{Stream: true, Stdin: true})
+	if err != nil {
+		return nil, err
+	}
+	defer attach.Close()
+
 	err = cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{})
 	if err != nil {
 		return nil, err
 	}
 
+	if _, err := attach.Conn.Write([]byte(token + "\n")); err != nil {
+		return nil, err
+	}
+
 	containerInspect, err := cli.ContainerInspect(ctx, resp.ID)
 	if err != nil {
 		return nil, err
 	}
 
+	// 既定の bridge 以外のネットワークにつないだときは Networks にしか IP アドレスが入らない
+	ipAddress := containerInspect.NetworkSettings.IPAddress
+	for _, network := range containerInspect.NetworkSettings.Networks {
+		if ipAddress == "" && network != nil {
+			ipAddress = network.IPAddress
+		}
+	}
+
 	return &Container{
 		Client:    cli,
 		Name:      containerName,
 		ID:        resp.ID,
-		IPAddress: containerInspect.NetworkSettings.IPAddress,
+		IPAddress: ipAddress,
+		Image:     image,
+		Token:     token,
+		WorkDir:   backend.Sandbox.workDir(),
 	}, nil
 }
 
+func (container *Container) workDir() string {
+	if container.WorkDir == "" {
+		return "/"
+	}
+
+	return container.WorkDir
+}
+
 // RemoveContainer ... コンテナを破棄する
 func (container *Container) RemoveContainer(ctx context.Context) {
 	_ = container.Client.ContainerStop(ctx, container.ID, nil)
 	_ = container.Client.ContainerRemove(
 		ctx,
 		container.ID,
-		types.ContainerRemoveOptions{RemoveVolumes: true, RemoveLinks: true, Force: true},
+		types.ContainerRemoveOptions{RemoveVolumes: true, Force: true},
 	)
+}
+
+// CopyFromContainer ... コンテナ内のファイルを読む。maxBytes バイトを超えていれば ErrSizeLimit を返す
+func (container *Container) CopyFromContainer(ctx context.Context, filepath string, maxBytes int64) ([]byte, error) {
+	reader, err := container.OpenFromContainer(ctx, filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return readLimited(reader, maxBytes)
+}
+
+// CopyDirFromContainer ... コンテナ内のディレクトリ以下のファイルをすべて読み、dir からの相対パス ("/" 区切り) -> 中身 を返す。
+// 合計が maxBytes バイトを超えていれば ErrSizeLimit を返す
+func (container *Container) CopyDirFromContainer(ctx context.Context, dir string, maxBytes int64) (map[string][]byte, error) {
+	dir = resolvePath(container.workDir(), dir)
+	reader, err := container.copyFromContainer(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
 
-	labelFilters := filters.NewArgs()
-	_, _ = container.Client.ContainersPrune(ctx, labelFilters)
+	// tar 内のパスは dir の最後の要素から始まる
+	base := path.Base(dir)
+
+	files := make(map[string][]byte)
+	remain := maxBytes
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := strings.TrimPrefix(path.Clean(header.Name), base+"/")
+		if header.Size > remain {
+			return nil, ErrSizeLimit
+		}
+		content, err := readLimited(tr, remain)
+		if err != nil {
+			return nil, err
+		}
+		remain -= int64(len(content))
+		files[name] = content
+	}
 }
 
-// CopyFromContainer ... コンテナからコピーしてくる
-func (container *Container) CopyFromContainer(ctx context.Context, filepath string) (*bytes.Buffer, error) {
-	var buffer *bytes.Buffer
+// OpenFromContainer ... コンテナ内のファイルを全部メモリに載せずに少しずつ読む。使い終わったら Close すること
+func (container *Container) OpenFromContainer(ctx context.Context, filepath string) (io.ReadCloser, error) {
+	filepath = resolvePath(container.workDir(), filepath)
+	reader, err := container.copyFromContainer(ctx, filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := tar.NewReader(reader)
+	header, err := tr.Next()
+	if err == io.EOF {
+		err = fmt.Errorf("%s: %w", filepath, os.ErrNotExist)
+	}
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	if header.Typeflag != tar.TypeReg {
+		reader.Close()
+		return nil, fmt.Errorf("%s is not a regular file", filepath)
+	}
+
+	return &tarEntryReader{Reader: tr, closer: reader}, nil
+}
+
+// filepath を含む tar を読む。filepath がなければ os.ErrNotExist を包んだエラーを返す
+func (container *Container) copyFromContainer(ctx context.Context, filepath string) (io.ReadCloser, error) {
 	reader, _, err := container.Client.CopyFromContainer(
 		ctx,
 		container.ID,
 		filepath,
 	)
+	if client.IsErrNotFound(err) {
+		return nil, fmt.Errorf("%s: %w", filepath, os.ErrNotExist)
+	}
 	if err != nil {
-		return buffer, err
+		return nil, err
 	}
 
-	defer reader.Close()
+	return reader, nil
+}
 
-	tr := tar.NewReader(reader)
-	_, _ = tr.Next()
-	buffer = new(bytes.Buffer)
-	_, _ = buffer.ReadFrom(tr)
+// tar の 1 つめのファイルを読み、Close で元の接続を閉じる
+type tarEntryReader struct {
+	*tar.Reader
+	closer io.Closer
+}
 
-	return buffer, nil
+func (reader *tarEntryReader) Close() error {
+	return reader.closer.Close()
 }
 
 // CopyToContainer ... コンテナにコピーする
 func (container *Container) CopyToContainer(ctx context.Context, hostFilePath string, containerFilePath string, mode int64) error {
-	var buf bytes.Buffer
-
 	usercodeFile, err := os.Open(hostFilePath)
 	if err != nil {
 		return err
@@ -116,34 +267,247 @@ func (container *Container) CopyToContainer(ctx context.Context, hostFilePath st
 		return err
 	}
 
-	tw := tar.NewWriter(&buf)
-	defer tw.Close()
+	return container.CopyBytesToContainer(ctx, content, containerFilePath, mode)
+}
+
+// CopyBytesToContainer ... content をコンテナ内のファイルとして書き込む
+func (container *Container) CopyBytesToContainer(ctx context.Context, content []byte, containerFilePath string, mode int64) error {
+	containerFilePath = resolvePath(container.workDir(), containerFilePath)
+	file := File{Path: path.Base(containerFilePath), Content: content, Mode: mode}
+
+	return container.CopyFilesToContainer(ctx, path.Dir(containerFilePath), []File{file})
+}
+
+// CopyFilesToContainer ... files をコンテナ内の dir 以下に書き込む。dir や途中のディレクトリはなければ作る。
+// tar は全体をメモリに載せずに少しずつ送る
+func (container *Container) CopyFilesToContainer(ctx context.Context, dir string, files []File) error {
+	dir = resolvePath(container.workDir(), dir)
+	// dir がまだないかもしれないので、パスに dir を含めて dir を含む既存のディレクトリに展開する。
+	// ルートファイルシステムが読み取り専用のときは WorkDir のボリュームにしか展開できない
+	extractDir := extractDir(container.workDir(), dir)
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeTar(writer, dir, extractDir, files))
+	}()
+	// 送り終える前に失敗したとき、writeTar が書き込みで止まったままにならないようにする
+	defer reader.Close()
+
+	return container.Client.CopyToContainer(
+		ctx,
+		container.ID,
+		extractDir,
+		reader,
+		types.CopyToContainerOptions{},
+	)
+}
+
+// dir に書き込む tar を展開するディレクトリ。dir が workDir 以下なら workDir、そうでなければ "/"
+func extractDir(workDir string, dir string) string {
+	if dir == workDir || strings.HasPrefix(dir, strings.TrimSuffix(workDir, "/")+"/") {
+		return workDir
+	}
+
+	return "/"
+}
+
+// files を dir 以下に置く tar を書く。tar 内のパスは base からの相対パス
+func writeTar(writer io.Writer, dir string, base string, files []File) error {
+	tw := tar.NewWriter(writer)
+
+	for _, file := range files {
+		name, err := file.pathIn(dir)
+		if err != nil {
+			return err
+		}
+
+		content, size := file.open()
+		err = tw.WriteHeader(
+			&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     strings.TrimPrefix(strings.TrimPrefix(name, base), "/"),
+				Mode:     file.Mode,
+				Size:     size,
+			},
+		)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(tw, content, size); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
 
-	err = tw.WriteHeader(
-		&tar.Header{
-			Name: containerFilePath,
-			Mode: mode,
-			Size: int64(len(content)),
+// ExecResult ... Exec の結果
+type ExecResult struct {
+	ExitCode int
+	Stdout   bytes.Buffer
+	Stderr   bytes.Buffer
+}
+
+// Exec ... コンテナ内の WorkDir でコマンドを実行し、終了コードと標準出力・標準エラー出力を返す。
+// ctx がキャンセルされたら出力の読み取りを打ち切ってエラーを返す。
+func (container *Container) Exec(ctx context.Context, cmd []string) (*ExecResult, error) {
+	execID, err := container.Client.ContainerExecCreate(
+		ctx,
+		container.ID,
+		types.ExecConfig{
+			AttachStdout: true,
+			AttachStderr: true,
+			WorkingDir:   container.workDir(),
+			Cmd:          cmd,
 		},
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if _, err := tw.Write(content); err != nil {
-		return err
+	resp, err := container.Client.ContainerExecAttach(ctx, execID.ID, types.ExecStartCheck{})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+
+	result := &ExecResult{}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := stdcopy.StdCopy(&result.Stdout, &result.Stderr, resp.Reader)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	inspect, err := container.Client.ContainerExecInspect(ctx, execID.ID)
+	if err != nil {
+		return nil, err
 	}
+	result.ExitCode = inspect.ExitCode
+
+	return result, nil
+}
+
+// Run で実行するコマンドを、子 cgroup に入れ終わるまで待たせる。標準入力の 1 行目を読んでから exec する
+const runGate = `read _ && exec "$@"`
 
-	err = container.Client.CopyToContainer(
+// Run ... コンテナ内の WorkDir で cmd を実行し、そのプロセスだけを子 cgroup に入れて測る。ジャッジはホストで動かすこと
+func (container *Container) Run(ctx context.Context, cmd []string, options RunOptions) (*RunResult, error) {
+	inspect, err := container.Client.ContainerInspect(ctx, container.ID)
+	if err != nil {
+		return nil, err
+	}
+	if inspect.State == nil || !inspect.State.Running {
+		return nil, errors.New("container is not running")
+	}
+	parent, err := pidCgroup(inspect.State.Pid)
+	if err != nil {
+		return nil, err
+	}
+
+	execID, err := container.Client.ContainerExecCreate(
 		ctx,
 		container.ID,
-		"/",
-		&buf,
-		types.CopyToContainerOptions{},
+		types.ExecConfig{
+			AttachStdin:  true,
+			AttachStdout: true,
+			AttachStderr: true,
+			WorkingDir:   container.workDir(),
+			Cmd:          append([]string{"sh", "-c", runGate, "sh"}, cmd...),
+		},
 	)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// 途中で失敗したときは、標準入力が閉じられて待っているコマンドは実行されずに終わる
+	resp, err := container.Client.ContainerExecAttach(ctx, execID.ID, types.ExecStartCheck{})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+
+	pid, err := container.execPid(ctx, execID.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	run, err := parent.newRun()
+	if err != nil {
+		return nil, err
+	}
+	defer run.remove()
+	if err := run.add(pid); err != nil {
+		return nil, err
+	}
+
+	if _, err := resp.Conn.Write([]byte("\n")); err != nil {
+		return nil, err
+	}
+	go func() {
+		if options.Stdin != nil {
+			_, _ = io.Copy(resp.Conn, options.Stdin)
+		}
+		_ = resp.CloseWrite()
+	}()
+
+	stdout, stderr := options.Stdout, options.Stderr
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := stdcopy.StdCopy(stdout, stderr, resp.Reader)
+		done <- err
+	}()
+
+	result := &RunResult{}
+	if result.TimedOut, err = waitRun(ctx, run, options.Timeout, done); err != nil {
+		return nil, err
+	}
+
+	execInspect, err := container.Client.ContainerExecInspect(ctx, execID.ID)
+	if err != nil {
+		return nil, err
+	}
+	result.ExitCode = execInspect.ExitCode
+
+	if result.Usage, result.OOMKilled, err = run.usage(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// exec したプロセスのホストでの pid を、起動するまで待って返す
+func (container *Container) execPid(ctx context.Context, execID string) (int, error) {
+	for i := 0; i < 100; i++ {
+		inspect, err := container.Client.ContainerExecInspect(ctx, execID)
+		if err != nil {
+			return 0, err
+		}
+		if inspect.Pid != 0 {
+			return inspect.Pid, nil
+		}
+
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
 	}
 
-	return nil
+	return 0, errors.New("exec did not start")
 }
@@ -0,0 +1,177 @@
+package dkrlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/util"
+)
+
+// DockerBackend ... docker のコンテナを Sandbox として使う
+type DockerBackend struct {
+	APIVersion string // 空なら 1.40
+	Sandbox    SandboxConfig
+}
+
+func (backend DockerBackend) client() (*client.Client, error) {
+	version := backend.APIVersion
+	if version == "" {
+		version = apiVersion
+	}
+
+	return client.NewClientWithOpts(client.WithVersion(version))
+}
+
+// EnsureImage ... image がなければ pull する。digest が指定されていれば中身が一致するかも確かめる
+func (backend DockerBackend) EnsureImage(ctx context.Context, image string) error {
+	cli, err := backend.client()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, image)
+	if client.IsErrNotFound(err) {
+		reader, err := cli.ImagePull(ctx, image, types.ImagePullOptions{})
+		if err != nil {
+			return err
+		}
+		// pull の失敗は進捗の中で知らされるので、読み終えてからもう一度確かめる
+		_, err = io.Copy(ioutil.Discard, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+
+		inspect, _, err = cli.ImageInspectWithRaw(ctx, image)
+	}
+	if err != nil {
+		return err
+	}
+
+	i := strings.LastIndex(image, "@")
+	if i < 0 {
+		return nil
+	}
+	for _, repoDigest := range inspect.RepoDigests {
+		if strings.HasSuffix(repoDigest, image[i:]) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("digest of %s does not match", image)
+}
+
+// Create ... コンテナを作って起動する
+func (backend DockerBackend) Create(ctx context.Context, image string, memoryLimit int, slot Slot) (Sandbox, error) {
+	container, err := backend.createContainer(ctx, image, util.GenRandomString(32), memoryLimit, slot)
+	if err != nil {
+		return nil, err
+	}
+
+	return dockerSandbox{container: container}, nil
+}
+
+// docker のコンテナを Sandbox として扱う
+type dockerSandbox struct {
+	container *Container
+}
+
+func (sandbox dockerSandbox) ID() string {
+	return sandbox.container.ID
+}
+
+func (sandbox dockerSandbox) Image() string {
+	return sandbox.container.Image
+}
+
+func (sandbox dockerSandbox) Address() string {
+	return fmt.Sprintf("%s:%d", sandbox.container.IPAddress, AgentPort)
+}
+
+func (sandbox dockerSandbox) Token() string {
+	return sandbox.container.Token
+}
+
+func (sandbox dockerSandbox) SetToken(token string) {
+	sandbox.container.Token = token
+}
+
+func (sandbox dockerSandbox) WorkDir() string {
+	return sandbox.container.workDir()
+}
+
+func (sandbox dockerSandbox) CopyIn(ctx context.Context, content []byte, path string, mode int64) error {
+	return sandbox.container.CopyBytesToContainer(ctx, content, path, mode)
+}
+
+func (sandbox dockerSandbox) CopyFilesIn(ctx context.Context, dir string, files []File) error {
+	return sandbox.container.CopyFilesToContainer(ctx, dir, files)
+}
+
+func (sandbox dockerSandbox) CopyOut(ctx context.Context, path string) (io.ReadCloser, error) {
+	return sandbox.container.OpenFromContainer(ctx, path)
+}
+
+func (sandbox dockerSandbox) CopyDirOut(ctx context.Context, dir string, maxBytes int64) (map[string][]byte, error) {
+	return sandbox.container.CopyDirFromContainer(ctx, dir, maxBytes)
+}
+
+func (sandbox dockerSandbox) Exec(ctx context.Context, cmd []string) (*ExecResult, error) {
+	return sandbox.container.Exec(ctx, cmd)
+}
+
+func (sandbox dockerSandbox) Update(ctx context.Context, memoryLimit int, slot Slot) error {
+	_, err := sandbox.container.Client.ContainerUpdate(ctx, sandbox.container.ID, resourcesUpdateConfig(memoryLimit, slot))
+
+	return err
+}
+
+func (sandbox dockerSandbox) Stats(ctx context.Context) (*Stats, error) {
+	inspect, err := sandbox.container.Client.ContainerInspect(ctx, sandbox.container.ID)
+	if err != nil {
+		return nil, err
+	}
+	if inspect.State == nil {
+		return nil, errors.New("container state is unknown")
+	}
+
+	stats := &Stats{Running: inspect.State.Running}
+	if !stats.Running {
+		return stats, nil
+	}
+
+	top, err := sandbox.container.Client.ContainerTop(ctx, sandbox.container.ID, nil)
+	if err != nil {
+		return nil, err
+	}
+	stats.Processes = len(top.Processes)
+
+	return stats, nil
+}
+
+func (sandbox dockerSandbox) Run(ctx context.Context, cmd []string, options RunOptions) (*RunResult, error) {
+	return sandbox.container.Run(ctx, cmd, options)
+}
+
+func (sandbox dockerSandbox) Destroy(ctx context.Context) error {
+	sandbox.container.RemoveContainer(ctx)
+
+	return nil
+}
+
+func resourcesUpdateConfig(memoryLimit int, slot Slot) container.UpdateConfig {
+	updateConfig := container.UpdateConfig{}
+	memoryResources(&updateConfig.Resources, memoryLimit)
+	slot.apply(&updateConfig.Resources)
+
+	return updateConfig
+}
@@ -0,0 +1,83 @@
+package dkrlib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// File ... コンテナにまとめてコピーするファイル
+type File struct {
+	Path    string // コピー先のディレクトリからの相対パス。"/" 区切り
+	Content []byte
+	Mode    int64
+
+	// Reader があれば Content の代わりに Reader から Size バイトを読んで書き込む。大きいファイルをメモリに載せずにコピーするときに使う
+	Reader io.Reader
+	Size   int64
+}
+
+// 書き込む中身とその大きさ
+func (file File) open() (io.Reader, int64) {
+	if file.Reader != nil {
+		return file.Reader, file.Size
+	}
+
+	return bytes.NewReader(file.Content), int64(len(file.Content))
+}
+
+// dir 以下の絶対パスにする。dir の外を指すパスはエラーにする
+func (file File) pathIn(dir string) (string, error) {
+	if file.Path == "" || path.IsAbs(file.Path) {
+		return "", fmt.Errorf("invalid file path %q", file.Path)
+	}
+
+	name := path.Clean(file.Path)
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("file path %q is outside of the directory", file.Path)
+	}
+
+	return path.Join("/", dir, name), nil
+}
+
+// p を dir からのパスとして絶対パスにする。絶対パスはそのまま
+func resolvePath(dir string, p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+
+	return path.Join("/", dir, p)
+}
+
+// FilesFromDir ... ホストの hostDir 以下のファイルをパーミッションを保ったまま読み込む
+func FilesFromDir(hostDir string) ([]File, error) {
+	var files []File
+
+	err := filepath.Walk(hostDir, func(hostPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(hostDir, hostPath)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(hostPath)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, File{Path: filepath.ToSlash(rel), Content: content, Mode: int64(info.Mode().Perm())})
+		return nil
+	})
+
+	return files, err
+}
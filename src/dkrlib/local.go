@@ -0,0 +1,23 @@
+package dkrlib
+
+// LocalBackend ... docker を使わず、Linux の名前空間と cgroup v2 で隔離したプロセスを Sandbox として使う。
+// Sandbox 内のプロセスはユーザ名前空間の root (ホストでは HostUID) として、capability を持たずに
+// ホストと別のネットワークで動く。ジャッジを root で動かし、main の最初で RunSandboxInit を呼ぶこと。Linux 5.6 以降が必要
+type LocalBackend struct {
+	ImageDir  string   // イメージ名のディレクトリにそれぞれのルートファイルシステムを展開しておく
+	WorkDir   string   // Sandbox ごとの作業ディレクトリを作る場所
+	CgroupDir string   // Sandbox ごとの cgroup を作る cgroup v2 のディレクトリ。cpu, cpuset, memory, pids を有効にしておくこと
+	AgentCmd  []string // Sandbox 内で起動するコンテナクライアントのコマンド。待ち受けるポートは環境変数 CAFECODER_PORT、トークンは標準入力の 1 行目で渡す
+	HostUID   int      // Sandbox 内の root (uid・gid 0) に対応させるホストの uid・gid。0 なら defaultHostUID
+}
+
+// HostUID を指定しなかったときに使うホストの uid・gid (nobody)
+const defaultHostUID = 65534
+
+func (backend LocalBackend) hostUID() int {
+	if backend.HostUID == 0 {
+		return defaultHostUID
+	}
+
+	return backend.HostUID
+}
@@ -0,0 +1,214 @@
+package dkrlib
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Sandbox のルートを起点にファイルを開く。Sandbox 内のプロセスが置いたシンボリックリンクや ".." は
+// openat2 の RESOLVE_IN_ROOT でルートの中で解決するので、ホストのファイルを指すことはない (Linux 5.6 から)
+type sandboxRoot struct {
+	dir *os.File
+}
+
+// ルートのパスを解決するときの設定。/proc/self/fd のような特殊なリンクはたどらない
+const sandboxResolve = unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS
+
+func openRoot(dir string) (*sandboxRoot, error) {
+	file, err := os.OpenFile(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sandboxRoot{dir: file}, nil
+}
+
+func (root *sandboxRoot) Close() error {
+	return root.dir.Close()
+}
+
+// Sandbox 内の絶対パス p を開く
+func (root *sandboxRoot) open(p string, flags int, mode uint32) (*os.File, error) {
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if name == "" {
+		name = "."
+	}
+
+	fd, err := unix.Openat2(int(root.dir.Fd()), name, &unix.OpenHow{
+		Flags:   uint64(flags | unix.O_CLOEXEC),
+		Mode:    uint64(mode),
+		Resolve: sandboxResolve,
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: "openat2", Path: p, Err: err}
+	}
+
+	return os.NewFile(uintptr(fd), p), nil
+}
+
+// dir とその途中のディレクトリがなければ uid の持ち物として作る
+func (root *sandboxRoot) mkdirAll(dir string, uid int) error {
+	dir = path.Clean("/" + dir)
+	if dir == "/" {
+		return nil
+	}
+	if err := root.mkdirAll(path.Dir(dir), uid); err != nil {
+		return err
+	}
+
+	parent, err := root.open(path.Dir(dir), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	err = unix.Mkdirat(int(parent.Fd()), path.Base(dir), 0755)
+	if err == unix.EEXIST {
+		return nil
+	}
+	if err != nil {
+		return &os.PathError{Op: "mkdirat", Path: dir, Err: err}
+	}
+
+	return unix.Fchownat(int(parent.Fd()), path.Base(dir), uid, uid, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// content から size バイトを読んで p に書き込む。Sandbox 内の root が扱えるように uid の持ち物にする
+func (root *sandboxRoot) writeFile(p string, content io.Reader, size int64, mode uint32, uid int) error {
+	if err := root.mkdirAll(path.Dir(p), uid); err != nil {
+		return err
+	}
+
+	// 既存の FIFO などで止まらないようにする
+	file, err := root.open(p, unix.O_WRONLY|unix.O_CREAT|unix.O_NOFOLLOW|unix.O_NONBLOCK, mode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", p)
+	}
+
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(file, content, size); err != nil {
+		return err
+	}
+	// 既存のファイルの権限は変わらず、umask もかかるので設定し直す
+	if err := file.Chmod(os.FileMode(mode)); err != nil {
+		return err
+	}
+
+	return file.Chown(uid, uid)
+}
+
+// p の通常のファイルを読むために開く。なければ os.ErrNotExist を包んだエラー
+func (root *sandboxRoot) openFile(p string) (*os.File, error) {
+	file, err := root.open(p, unix.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a regular file", p)
+	}
+
+	return file, nil
+}
+
+// dir 以下の通常のファイルを読み、dir からの相対パス -> 中身 を返す。シンボリックリンクはたどらない。
+// 合計が maxBytes バイトを超えていれば ErrSizeLimit を返す
+func (root *sandboxRoot) readDir(dir string, maxBytes int64) (map[string][]byte, error) {
+	file, err := root.open(dir, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	files := make(map[string][]byte)
+	remain := maxBytes
+	if err := readDirAt(file, "", files, &remain); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func readDirAt(dir *os.File, prefix string, files map[string][]byte, remain *int64) error {
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := prefix + entry.Name()
+
+		// 一覧を取ってから差し替えられていても、シンボリックリンクや dir の外はたどらない
+		how := &unix.OpenHow{Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS}
+		switch {
+		case entry.IsDir():
+			how.Flags = unix.O_RDONLY | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_CLOEXEC
+		case entry.Mode().IsRegular():
+			if entry.Size() > *remain {
+				return ErrSizeLimit
+			}
+			how.Flags = unix.O_RDONLY | unix.O_NOFOLLOW | unix.O_NONBLOCK | unix.O_CLOEXEC
+		default:
+			continue
+		}
+
+		fd, err := unix.Openat2(int(dir.Fd()), entry.Name(), how)
+		if err != nil {
+			return &os.PathError{Op: "openat2", Path: name, Err: err}
+		}
+		child := os.NewFile(uintptr(fd), name)
+
+		if entry.IsDir() {
+			err = readDirAt(child, name+"/", files, remain)
+		} else {
+			err = readRegular(child, name, files, remain)
+		}
+		child.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readRegular(file *os.File, name string, files map[string][]byte, remain *int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	content, err := readLimited(file, *remain)
+	if err != nil {
+		return err
+	}
+	*remain -= int64(len(content))
+	files[name] = content
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package dkrlib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Sandbox 内のコマンドを起動する前処理としてジャッジ自身を実行するときの argv[0]
+const sandboxInitName = "cafecoder-sandbox-init"
+
+// RunSandboxInit ... ジャッジが Sandbox の前処理として実行されたのなら、前処理をしてコマンドを exec する。
+// そうでなければ何もしない。main の最初で呼ぶこと
+//
+// 引数は <作業ディレクトリ> <ループバックを使うか> <コマンド...>。fd 3 にジャッジの実行ファイル、fd 4 にルートを開いて渡す。
+// fd 5 はジャッジが cgroup に入れ終わったら閉じるパイプで、それまでコマンドを実行せずに待つ。
+// ユーザ名前空間の root として動くので、ホストに対しては LocalBackend.HostUID の権限しかない
+func RunSandboxInit() {
+	if len(os.Args) < 4 || os.Args[0] != sandboxInitName {
+		return
+	}
+
+	if err := sandboxInit(os.Args[1], os.Args[2] == "lo", os.Args[3:]); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox init: %v\n", err)
+		os.Exit(127)
+	}
+}
+
+func sandboxInit(dir string, loopback bool, cmd []string) error {
+	// no_new_privs と bounding set はスレッドごとなので、exec するスレッドで設定する
+	runtime.LockOSThread()
+
+	// 前処理で使った資源がコマンドの分として測られないように、cgroup に入れられるまで何もしない
+	gate := os.NewFile(5, "gate")
+	if _, err := io.Copy(ioutil.Discard, gate); err != nil {
+		return fmt.Errorf("gate: %w", err)
+	}
+	gate.Close()
+
+	// ジャッジの実行ファイルとルートをコマンドに渡さない
+	syscall.CloseOnExec(3)
+	syscall.CloseOnExec(4)
+
+	if loopback {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("loopback: %w", err)
+		}
+	}
+
+	// ホストでのルートまでのパスは HostUID からたどれないかもしれないので、開いてあるルートに移ってから chroot する
+	if err := syscall.Fchdir(4); err != nil {
+		return fmt.Errorf("fchdir: %w", err)
+	}
+	if err := syscall.Chroot("."); err != nil {
+		return fmt.Errorf("chroot: %w", err)
+	}
+	if err := syscall.Chdir(dir); err != nil {
+		return fmt.Errorf("chdir: %w", err)
+	}
+
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("no_new_privs: %w", err)
+	}
+	// bounding set を空にすれば、exec したあとは root でも capability を持たない
+	for capability := 0; ; capability++ {
+		err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(capability), 0, 0, 0)
+		if err == unix.EINVAL {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("drop capability %d: %w", capability, err)
+		}
+	}
+	var data [2]unix.CapUserData
+	if err := unix.Capset(&unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}, &data[0]); err != nil {
+		return fmt.Errorf("capset: %w", err)
+	}
+
+	path, err := exec.LookPath(cmd[0])
+	if err != nil {
+		return err
+	}
+
+	return syscall.Exec(path, cmd, os.Environ())
+}
+
+// 新しいネットワークの名前空間のループバック (lo) を使えるようにする
+func loopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	var ifreq struct {
+		name  [unix.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifreq.name[:], "lo")
+	ifreq.flags = unix.IFF_UP | unix.IFF_LOOPBACK | unix.IFF_RUNNING
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifreq))); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,642 @@
+package dkrlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/util"
+)
+
+// Sandbox 内のプロセスを分ける名前空間。
+// ネットワークも分けるので、ジャッジはコンテナクライアントに proxy を通してつなぐ
+const localCloneflags = syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS | syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET
+
+// Sandbox 内のプロセスに渡す PATH
+const localPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Sandbox の /dev に置くデバイス。ホストの /dev をまるごと見せないようにする
+var localDevices = []string{"null", "zero", "full", "random", "urandom"}
+
+// コンテナクライアントが起動して接続を受けられるようになるまで待つ時間
+const localAgentDialTimeout = 10 * time.Second
+
+// EnsureImage ... image のルートファイルシステムが展開されているかを確かめる。pull はできない
+func (backend LocalBackend) EnsureImage(ctx context.Context, image string) error {
+	return checkImageDir(filepath.Join(backend.ImageDir, image))
+}
+
+func checkImageDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	return nil
+}
+
+// Create ... イメージのルートファイルシステムに overlay を重ねて、その中でコンテナクライアントを起動する
+func (backend LocalBackend) Create(ctx context.Context, image string, memoryLimit int, slot Slot) (Sandbox, error) {
+	lower := filepath.Join(backend.ImageDir, image)
+	if err := checkImageDir(lower); err != nil {
+		return nil, err
+	}
+
+	id := util.GenRandomString(32)
+	sandbox := &localSandbox{
+		id:      id,
+		image:   image,
+		dir:     filepath.Join(backend.WorkDir, id),
+		cgroup:  filepath.Join(backend.CgroupDir, id),
+		hostUID: backend.hostUID(),
+		token:   util.GenRandomString(tokenLength),
+		done:    make(chan struct{}),
+	}
+
+	if err := sandbox.setup(lower, memoryLimit, slot); err != nil {
+		_ = sandbox.Destroy(ctx)
+		return nil, err
+	}
+	if err := sandbox.startAgent(backend.AgentCmd); err != nil {
+		_ = sandbox.Destroy(ctx)
+		return nil, err
+	}
+
+	return sandbox, nil
+}
+
+type localSandbox struct {
+	id      string
+	image   string
+	dir     string // upper, work, root を置くディレクトリ
+	cgroup  string
+	hostUID int
+	token   string
+
+	agent    *exec.Cmd
+	done     chan struct{} // コンテナクライアントが終了したら閉じる
+	listener net.Listener  // コンテナクライアントへの proxy がホストで待ち受ける
+
+	mounts []string // setup でマウントしたホストのパス。Destroy で逆順に外す
+}
+
+func (sandbox *localSandbox) root() string {
+	return filepath.Join(sandbox.dir, "root")
+}
+
+// ルートファイルシステムと cgroup を用意する
+func (sandbox *localSandbox) setup(lower string, memoryLimit int, slot Slot) error {
+	upper := filepath.Join(sandbox.dir, "upper")
+	work := filepath.Join(sandbox.dir, "work")
+	for _, dir := range []string{upper, work, sandbox.root()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	// overlay の / は upper の持ち主になる。docker と同じく Sandbox 内の root が / に書き込めるようにする
+	if err := os.Chown(upper, sandbox.hostUID, sandbox.hostUID); err != nil {
+		return err
+	}
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	if err := syscall.Mount("overlay", sandbox.root(), "overlay", 0, options); err != nil {
+		return fmt.Errorf("mount overlay: %w", err)
+	}
+	sandbox.mounts = append(sandbox.mounts, sandbox.root())
+
+	// /dev/null などを使えるようにする。まだ Sandbox 内のプロセスはいないので、パスをそのまま使ってよい
+	dev := filepath.Join(sandbox.root(), "dev")
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		return err
+	}
+	for _, device := range localDevices {
+		target := filepath.Join(dev, device)
+		if err := ioutil.WriteFile(target, nil, 0644); err != nil {
+			return err
+		}
+		if err := syscall.Mount(filepath.Join("/dev", device), target, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("mount /dev/%s: %w", device, err)
+		}
+		sandbox.mounts = append(sandbox.mounts, target)
+	}
+
+	if err := os.Mkdir(sandbox.cgroup, 0755); err != nil {
+		return err
+	}
+	if err := writeCgroupFile(sandbox.cgroup, "pids.max", "1024"); err != nil {
+		return err
+	}
+
+	return sandbox.Update(context.Background(), memoryLimit, slot)
+}
+
+// コンテナクライアントを Sandbox のネットワーク内の AgentPort で起動し、ホスト側の proxy を用意する
+func (sandbox *localSandbox) startAgent(agentCmd []string) error {
+	if len(agentCmd) == 0 {
+		return errors.New("agent command is empty")
+	}
+
+	agent, err := sandbox.command(agentCmd, true)
+	if err != nil {
+		return err
+	}
+	agent.Env = append(agent.Env, "CAFECODER_PORT="+strconv.Itoa(AgentPort))
+	agent.Stdin = strings.NewReader(sandbox.token + "\n")
+	if err := sandbox.start(agent, sandbox.addProc); err != nil {
+		return err
+	}
+	sandbox.agent = agent
+
+	go func() {
+		_ = sandbox.agent.Wait()
+		close(sandbox.done)
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	sandbox.listener = listener
+	go sandbox.serveProxy()
+
+	return nil
+}
+
+// Sandbox 内で動かすコマンドを作る。ジャッジ自身を RunSandboxInit の前処理として実行し、
+// chroot して capability を捨ててから cmd を exec させる。loopback なら lo を使えるようにする
+func (sandbox *localSandbox) command(cmd []string, loopback bool) (*exec.Cmd, error) {
+	// ジャッジの実行ファイルとルートは Sandbox の uid からたどれない場所にあるかもしれないので、開いて渡す
+	self, err := os.Open("/proc/self/exe")
+	if err != nil {
+		return nil, err
+	}
+	root, err := os.OpenFile(sandbox.root(), unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		self.Close()
+		return nil, err
+	}
+
+	lo := "-"
+	if loopback {
+		lo = "lo"
+	}
+
+	command := &exec.Cmd{
+		Path:       "/proc/self/fd/3",
+		Args:       append([]string{sandboxInitName, sandbox.WorkDir(), lo}, cmd...),
+		Env:        []string{localPath},
+		ExtraFiles: []*os.File{self, root},
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags:  localCloneflags,
+			UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: sandbox.hostUID, Size: 1}},
+			GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: sandbox.hostUID, Size: 1}},
+			// 名前空間の root になってから exec しないと前処理の capability がなくなる
+			Credential: &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: true},
+			Setpgid:    true,
+			Pdeathsig:  syscall.SIGKILL,
+		},
+	}
+
+	return command, nil
+}
+
+// コマンドを起動し、add で cgroup に入れ終わってから前処理に cmd を exec させる
+func (sandbox *localSandbox) start(command *exec.Cmd, add func(pid int) error) error {
+	gate, release, err := os.Pipe()
+	if err != nil {
+		for _, file := range command.ExtraFiles {
+			file.Close()
+		}
+		return err
+	}
+	defer release.Close()
+
+	command.ExtraFiles = append(command.ExtraFiles, gate)
+	err = command.Start()
+	for _, file := range command.ExtraFiles {
+		file.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := add(command.Process.Pid); err != nil {
+		_ = command.Process.Kill()
+		_ = command.Wait()
+		return err
+	}
+
+	return release.Close()
+}
+
+// pid のプロセスを Sandbox の cgroup に入れる
+func (sandbox *localSandbox) addProc(pid int) error {
+	return writeCgroupFile(sandbox.cgroup, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// ホストの 127.0.0.1 で受けた接続を、Sandbox のネットワーク内のコンテナクライアントにつなぐ
+func (sandbox *localSandbox) serveProxy() {
+	for {
+		conn, err := sandbox.listener.Accept()
+		if err != nil {
+			return
+		}
+		go sandbox.proxy(conn)
+	}
+}
+
+func (sandbox *localSandbox) proxy(conn net.Conn) {
+	agentConn, err := sandbox.dialAgent()
+	if err != nil {
+		fmt.Printf("sandbox %s: connect to agent: %v\n", sandbox.id, err)
+		conn.Close()
+		return
+	}
+
+	// 片方向ずつ送り、送り終えたら相手に EOF を伝える。失敗したら両方閉じる
+	finished := make(chan struct{})
+	var wg sync.WaitGroup
+	relay := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		if _, err := io.Copy(dst, src); err != nil {
+			conn.Close()
+			agentConn.Close()
+			return
+		}
+		_ = dst.(*net.TCPConn).CloseWrite()
+	}
+	wg.Add(2)
+	go relay(agentConn, conn)
+	go relay(conn, agentConn)
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-sandbox.done:
+		conn.Close()
+		agentConn.Close()
+		<-finished
+	}
+	conn.Close()
+	agentConn.Close()
+}
+
+// コンテナクライアントのネットワークの名前空間に入ってソケットを作り、接続する。
+// 起動直後でまだ待ち受けていなければ少し待ってやり直す
+func (sandbox *localSandbox) dialAgent() (net.Conn, error) {
+	deadline := time.Now().Add(localAgentDialTimeout)
+	for {
+		conn, err := sandbox.dialAgentOnce()
+		if err == nil || time.Now().After(deadline) {
+			return conn, err
+		}
+
+		select {
+		case <-sandbox.done:
+			return nil, errors.New("agent exited")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (sandbox *localSandbox) dialAgentOnce() (net.Conn, error) {
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	result := make(chan dialed, 1)
+
+	// 名前空間はスレッドごとなので、別の goroutine でスレッドを固定して切り替える
+	go func() {
+		runtime.LockOSThread()
+
+		hostNS, err := os.Open("/proc/thread-self/ns/net")
+		if err != nil {
+			runtime.UnlockOSThread()
+			result <- dialed{err: err}
+			return
+		}
+		defer hostNS.Close()
+
+		agentNS, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", sandbox.agent.Process.Pid))
+		if err != nil {
+			runtime.UnlockOSThread()
+			result <- dialed{err: err}
+			return
+		}
+		defer agentNS.Close()
+
+		if err := unix.Setns(int(agentNS.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			result <- dialed{err: err}
+			return
+		}
+
+		// ソケットは作ったときの名前空間に属するので、戻したあとも使える
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", AgentPort), time.Second)
+
+		// 戻せなかったスレッドは使い回さず、goroutine の終わりで捨てさせる
+		if err := unix.Setns(int(hostNS.Fd()), unix.CLONE_NEWNET); err == nil {
+			runtime.UnlockOSThread()
+		}
+		result <- dialed{conn: conn, err: err}
+	}()
+
+	dial := <-result
+	return dial.conn, dial.err
+}
+
+func (sandbox *localSandbox) ID() string {
+	return sandbox.id
+}
+
+func (sandbox *localSandbox) Image() string {
+	return sandbox.image
+}
+
+// Address ... ホスト側の proxy のアドレス
+func (sandbox *localSandbox) Address() string {
+	return sandbox.listener.Addr().String()
+}
+
+func (sandbox *localSandbox) Token() string {
+	return sandbox.token
+}
+
+func (sandbox *localSandbox) SetToken(token string) {
+	sandbox.token = token
+}
+
+// WorkDir ... ルートファイルシステムは overlay で書き込めるので "/" を使う
+func (sandbox *localSandbox) WorkDir() string {
+	return "/"
+}
+
+func (sandbox *localSandbox) CopyIn(ctx context.Context, content []byte, path string, mode int64) error {
+	file := File{Path: strings.TrimPrefix(resolvePath(sandbox.WorkDir(), path), "/"), Content: content, Mode: mode}
+
+	return sandbox.CopyFilesIn(ctx, "/", []File{file})
+}
+
+// CopyFilesIn ... Sandbox 内のシンボリックリンクは Sandbox のルートの中で解決するので、ホストのファイルには書き込まない
+func (sandbox *localSandbox) CopyFilesIn(ctx context.Context, dir string, files []File) error {
+	root, err := openRoot(sandbox.root())
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	for _, file := range files {
+		path, err := file.pathIn(resolvePath(sandbox.WorkDir(), dir))
+		if err != nil {
+			return err
+		}
+
+		content, size := file.open()
+		if err := root.writeFile(path, content, size, uint32(file.Mode), sandbox.hostUID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CopyOut ... Sandbox 内のシンボリックリンクは Sandbox のルートの中で解決するので、ホストのファイルは読まない
+func (sandbox *localSandbox) CopyOut(ctx context.Context, path string) (io.ReadCloser, error) {
+	root, err := openRoot(sandbox.root())
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+
+	return root.openFile(resolvePath(sandbox.WorkDir(), path))
+}
+
+// CopyDirOut ... dir 以下のシンボリックリンクはたどらない
+func (sandbox *localSandbox) CopyDirOut(ctx context.Context, dir string, maxBytes int64) (map[string][]byte, error) {
+	root, err := openRoot(sandbox.root())
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+
+	return root.readDir(resolvePath(sandbox.WorkDir(), dir), maxBytes)
+}
+
+// Exec ... コマンドを Sandbox 内で実行する。ネットワークは使えない。ctx がキャンセルされたらプロセスを殺してエラーを返す
+func (sandbox *localSandbox) Exec(ctx context.Context, cmd []string) (*ExecResult, error) {
+	if len(cmd) == 0 {
+		return nil, errors.New("command is empty")
+	}
+
+	result := &ExecResult{}
+
+	command, err := sandbox.command(cmd, false)
+	if err != nil {
+		return nil, err
+	}
+	command.Stdout = &result.Stdout
+	command.Stderr = &result.Stderr
+	if err := sandbox.start(command, sandbox.addProc); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- command.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			return nil, err
+		}
+	case <-ctx.Done():
+		_ = syscall.Kill(-command.Process.Pid, syscall.SIGKILL)
+		<-done
+		return nil, ctx.Err()
+	}
+
+	result.ExitCode = command.ProcessState.ExitCode()
+
+	return result, nil
+}
+
+func (sandbox *localSandbox) Update(ctx context.Context, memoryLimit int, slot Slot) error {
+	memory := strconv.FormatInt(int64(memoryLimit)*1024*1024, 10)
+	if err := writeCgroupFile(sandbox.cgroup, "memory.max", memory); err != nil {
+		return err
+	}
+	// docker と同じく、スワップは使わせない
+	if err := writeCgroupFile(sandbox.cgroup, "memory.swap.max", "0"); err != nil {
+		return err
+	}
+
+	if len(slot.CPUs) > 0 {
+		if err := writeCgroupFile(sandbox.cgroup, "cpuset.cpus", slot.CpusetCpus()); err != nil {
+			return err
+		}
+	}
+	if slot.CPUQuota > 0 {
+		return writeCgroupFile(sandbox.cgroup, "cpu.max", fmt.Sprintf("%d %d", slot.cpuQuota(), cpuPeriod))
+	}
+
+	return nil
+}
+
+func (sandbox *localSandbox) Stats(ctx context.Context) (*Stats, error) {
+	stats := &Stats{Running: true}
+	select {
+	case <-sandbox.done:
+		stats.Running = false
+	default:
+	}
+
+	// Run の途中なら子 cgroup にいるので、その下もすべて数える
+	err := filepath.Walk(sandbox.cgroup, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		procs, err := ioutil.ReadFile(filepath.Join(path, "cgroup.procs"))
+		if err != nil {
+			return err
+		}
+		stats.Processes += len(strings.Fields(string(procs)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func (sandbox *localSandbox) Run(ctx context.Context, cmd []string, options RunOptions) (*RunResult, error) {
+	if len(cmd) == 0 {
+		return nil, errors.New("command is empty")
+	}
+
+	run, err := cgroupParent{memoryDir: sandbox.cgroup, cpuDir: sandbox.cgroup, v2: true}.newRun()
+	if err != nil {
+		return nil, err
+	}
+	defer run.remove()
+
+	command, err := sandbox.command(cmd, false)
+	if err != nil {
+		return nil, err
+	}
+	command.Stdout = options.Stdout
+	command.Stderr = options.Stderr
+	// Wait が標準入力の読み込みを待たないように、自分で書き込む
+	var stdin io.WriteCloser
+	if options.Stdin != nil {
+		if stdin, err = command.StdinPipe(); err != nil {
+			return nil, err
+		}
+	}
+	if err := sandbox.start(command, run.add); err != nil {
+		return nil, err
+	}
+	if stdin != nil {
+		go func() {
+			_, _ = io.Copy(stdin, options.Stdin)
+			stdin.Close()
+		}()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := command.Wait()
+		if _, ok := err.(*exec.ExitError); ok {
+			err = nil
+		}
+		done <- err
+	}()
+
+	result := &RunResult{}
+	if result.TimedOut, err = waitRun(ctx, run, options.Timeout, done); err != nil {
+		return nil, err
+	}
+	result.ExitCode = command.ProcessState.ExitCode()
+
+	if result.Usage, result.OOMKilled, err = run.usage(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Destroy ... Sandbox 内のプロセスをすべて殺し、ファイルと cgroup を消す
+func (sandbox *localSandbox) Destroy(ctx context.Context) error {
+	sandbox.kill()
+	if sandbox.agent != nil {
+		<-sandbox.done
+	}
+	if sandbox.listener != nil {
+		sandbox.listener.Close()
+	}
+
+	// 外せなかったマウントがあるまま消すと、ホストの /dev などを消してしまう
+	for i := len(sandbox.mounts) - 1; i >= 0; i-- {
+		if err := syscall.Unmount(sandbox.mounts[i], syscall.MNT_DETACH|unix.UMOUNT_NOFOLLOW); err != nil {
+			return fmt.Errorf("unmount %s: %w", sandbox.mounts[i], err)
+		}
+	}
+	sandbox.mounts = nil
+	if err := os.RemoveAll(sandbox.dir); err != nil {
+		return err
+	}
+
+	// プロセスがいなくなるまで cgroup は消せない
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(sandbox.cgroup); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return err
+}
+
+// cgroup 内のプロセスをすべて殺す。cgroup.kill は Linux 5.14 から
+func (sandbox *localSandbox) kill() {
+	if sandbox.agent != nil {
+		_ = syscall.Kill(-sandbox.agent.Process.Pid, syscall.SIGKILL)
+	}
+
+	if err := writeCgroupFile(sandbox.cgroup, "cgroup.kill", "1"); err == nil {
+		return
+	}
+
+	procs, err := ioutil.ReadFile(filepath.Join(sandbox.cgroup, "cgroup.procs"))
+	if err != nil {
+		return
+	}
+	for _, pid := range strings.Fields(string(procs)) {
+		if pid, err := strconv.Atoi(pid); err == nil {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package dkrlib
+
+import (
+	"context"
+	"errors"
+)
+
+// EnsureImage ... Linux 以外では使えない
+func (backend LocalBackend) EnsureImage(ctx context.Context, image string) error {
+	return errors.New("local sandbox backend is only supported on linux")
+}
+
+// Create ... Linux 以外では使えない
+func (backend LocalBackend) Create(ctx context.Context, image string, memoryLimit int, slot Slot) (Sandbox, error) {
+	return nil, errors.New("local sandbox backend is only supported on linux")
+}
+
+// RunSandboxInit ... Linux 以外では何もしない
+func RunSandboxInit() {}
@@ -0,0 +1,293 @@
+package dkrlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/util"
+)
+
+// PoolConfig ... Pool の設定
+type PoolConfig struct {
+	Size     int      // イメージごとに起動しておく Sandbox の数。0 なら毎回作る
+	MaxUses  int      // 1 つの Sandbox を貸し出す最大回数。ResetCmd か Rekey がなければ常に 1 (使い回さない)
+	ResetCmd []string // 使い回す前に Sandbox 内で実行して、前の提出のファイルを消すコマンド
+
+	// Rekey ... 使い回す前にコンテナクライアントのトークンを token に変える。
+	// 前の提出に知られたトークンを使わせないため、なければ使い回さない
+	Rekey func(ctx context.Context, sandbox Sandbox, token string) error
+
+	// HealthCheck ... 貸し出す前にコンテナクライアントが応答できるかを確かめる。なければ確かめない
+	HealthCheck func(ctx context.Context, sandbox Sandbox) error
+}
+
+// Pool ... 起動済みの Sandbox をイメージごとに用意しておき、提出ごとに貸し出す
+type Pool struct {
+	backend Backend
+	config  PoolConfig
+
+	mu     sync.Mutex
+	images map[string]*imagePool
+	uses   map[Sandbox]int // 貸し出した回数
+	procs  map[Sandbox]int // 貸し出したときに Sandbox で動いていたプロセスの数
+	closed bool
+
+	working sync.WaitGroup // バックグラウンドで作成・破棄している Sandbox
+}
+
+type imagePool struct {
+	idle    chan Sandbox
+	pending int // 作成中の Sandbox の数
+}
+
+// NewPool ... backend で Sandbox を作る Pool を作る。Sandbox は Warm か最初の Checkout から用意しはじめる
+func NewPool(backend Backend, config PoolConfig) *Pool {
+	if config.Size < 0 {
+		config.Size = 0
+	}
+	if config.MaxUses < 1 || len(config.ResetCmd) == 0 || config.Rekey == nil {
+		config.MaxUses = 1
+	}
+
+	return &Pool{
+		backend: backend,
+		config:  config,
+		images:  make(map[string]*imagePool),
+		uses:    make(map[Sandbox]int),
+		procs:   make(map[Sandbox]int),
+	}
+}
+
+func (pool *Pool) imagePool(image string) *imagePool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if _, exist := pool.images[image]; !exist {
+		pool.images[image] = &imagePool{idle: make(chan Sandbox, pool.config.Size)}
+	}
+
+	return pool.images[image]
+}
+
+// Warm ... image の Sandbox を Size 個になるまでバックグラウンドで起動する
+func (pool *Pool) Warm(image string) {
+	imagePool := pool.imagePool(image)
+
+	pool.mu.Lock()
+	n := pool.config.Size - len(imagePool.idle) - imagePool.pending
+	if n <= 0 || pool.closed {
+		pool.mu.Unlock()
+		return
+	}
+	imagePool.pending += n
+	pool.working.Add(n)
+	pool.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		go func() {
+			defer pool.working.Done()
+
+			sandbox, err := pool.backend.Create(context.Background(), image, DefaultMemoryLimit, Slot{})
+
+			pool.mu.Lock()
+			imagePool.pending--
+			pool.mu.Unlock()
+
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "pool: %s\n", err)
+				return
+			}
+			pool.put(sandbox)
+		}()
+	}
+}
+
+// Checkout ... image の Sandbox をメモリ制限 memoryLimit (MiB) と枠 slot の CPU にして貸し出す。
+// 起動済みのものがなければその場で作る。使い終わったら Return すること
+func (pool *Pool) Checkout(ctx context.Context, image string, memoryLimit int, slot Slot) (Sandbox, error) {
+	imagePool := pool.imagePool(image)
+	defer pool.Warm(image)
+
+	for {
+		select {
+		case sandbox := <-imagePool.idle:
+			stats, err := pool.prepare(ctx, sandbox, memoryLimit, slot)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "pool: discard %s: %s\n", sandbox.ID(), err)
+				pool.discard(sandbox)
+				continue
+			}
+
+			pool.use(sandbox, stats.Processes)
+			return sandbox, nil
+		default:
+			sandbox, err := pool.backend.Create(ctx, image, memoryLimit, slot)
+			if err != nil {
+				return nil, err
+			}
+
+			// 使い回すなら、返されたときに前の提出のプロセスが残っていないかを比べるために数えておく
+			processes := 0
+			if pool.config.MaxUses > 1 {
+				stats, err := sandbox.Stats(ctx)
+				if err != nil {
+					pool.discard(sandbox)
+					return nil, err
+				}
+				processes = stats.Processes
+			}
+
+			pool.use(sandbox, processes)
+			return sandbox, nil
+		}
+	}
+}
+
+// CheckoutNew ... 提出を動かしたことのない Sandbox を新しく作って貸し出す。
+// チェッカーなど、提出に触られていない環境で動かしたいものに使う。使い終わったら Return すること
+func (pool *Pool) CheckoutNew(ctx context.Context, image string, memoryLimit int, slot Slot) (Sandbox, error) {
+	sandbox, err := pool.backend.Create(ctx, image, memoryLimit, slot)
+	if err != nil {
+		return nil, err
+	}
+
+	pool.use(sandbox, 0)
+	return sandbox, nil
+}
+
+// Return ... 貸し出した Sandbox を返す。
+// failed が true のとき、MaxUses 回使ったとき、提出のプロセスが残っているとき、片付けに失敗したときは Sandbox を破棄して作り直す
+func (pool *Pool) Return(ctx context.Context, sandbox Sandbox, failed bool) {
+	pool.mu.Lock()
+	uses := pool.uses[sandbox]
+	procs := pool.procs[sandbox]
+	pool.mu.Unlock()
+
+	if failed || uses >= pool.config.MaxUses {
+		pool.discard(sandbox)
+		pool.Warm(sandbox.Image())
+		return
+	}
+
+	// 提出が残したプロセスは次の提出を覗けるので、確実に消すために使い回さない
+	stats, err := sandbox.Stats(ctx)
+	if err == nil && (!stats.Running || stats.Processes > procs) {
+		err = fmt.Errorf("%d processes left (%d when checked out)", stats.Processes, procs)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pool: discard %s: %s\n", sandbox.ID(), err)
+		pool.discard(sandbox)
+		pool.Warm(sandbox.Image())
+		return
+	}
+
+	if err := reset(ctx, sandbox, pool.config.ResetCmd); err != nil {
+		fmt.Fprintf(os.Stderr, "pool: discard %s: %s\n", sandbox.ID(), err)
+		pool.discard(sandbox)
+		pool.Warm(sandbox.Image())
+		return
+	}
+
+	token := util.GenRandomString(tokenLength)
+	if err := pool.config.Rekey(ctx, sandbox, token); err != nil {
+		fmt.Fprintf(os.Stderr, "pool: discard %s: rekey: %s\n", sandbox.ID(), err)
+		pool.discard(sandbox)
+		pool.Warm(sandbox.Image())
+		return
+	}
+	sandbox.SetToken(token)
+
+	pool.put(sandbox)
+}
+
+// Close ... 起動しておいた Sandbox をすべて破棄し、バックグラウンドでの作成・破棄が終わるまで待つ。
+// Close のあとに返された Sandbox は破棄する
+func (pool *Pool) Close(ctx context.Context) {
+	pool.mu.Lock()
+	pool.closed = true
+	for _, imagePool := range pool.images {
+		for len(imagePool.idle) > 0 {
+			sandbox := <-imagePool.idle
+			_ = sandbox.Destroy(ctx)
+			delete(pool.uses, sandbox)
+			delete(pool.procs, sandbox)
+		}
+	}
+	pool.mu.Unlock()
+
+	pool.working.Wait()
+}
+
+func (pool *Pool) use(sandbox Sandbox, processes int) {
+	pool.mu.Lock()
+	pool.uses[sandbox]++
+	pool.procs[sandbox] = processes
+	pool.mu.Unlock()
+}
+
+func (pool *Pool) put(sandbox Sandbox) {
+	imagePool := pool.imagePool(sandbox.Image())
+
+	pool.mu.Lock()
+	if !pool.closed {
+		select {
+		case imagePool.idle <- sandbox:
+			pool.mu.Unlock()
+			return
+		default:
+		}
+	}
+	pool.mu.Unlock()
+
+	pool.discard(sandbox)
+}
+
+// バックグラウンドで Sandbox を破棄する
+func (pool *Pool) discard(sandbox Sandbox) {
+	pool.mu.Lock()
+	delete(pool.uses, sandbox)
+	delete(pool.procs, sandbox)
+	pool.working.Add(1)
+	pool.mu.Unlock()
+
+	go func() {
+		defer pool.working.Done()
+		if err := sandbox.Destroy(context.Background()); err != nil {
+			fmt.Fprintf(os.Stderr, "pool: destroy %s: %s\n", sandbox.ID(), err)
+		}
+	}()
+}
+
+// 貸し出す前に、Sandbox とコンテナクライアントが動いていることを確かめてメモリ制限と CPU を設定する
+func (pool *Pool) prepare(ctx context.Context, sandbox Sandbox, memoryLimit int, slot Slot) (*Stats, error) {
+	stats, err := sandbox.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !stats.Running {
+		return nil, errors.New("sandbox is not running")
+	}
+	if pool.config.HealthCheck != nil {
+		if err := pool.config.HealthCheck(ctx, sandbox); err != nil {
+			return nil, fmt.Errorf("health check: %w", err)
+		}
+	}
+
+	return stats, sandbox.Update(ctx, memoryLimit, slot)
+}
+
+// 使い回す前に前の提出のファイルを消す
+func reset(ctx context.Context, sandbox Sandbox, resetCmd []string) error {
+	res, err := sandbox.Exec(ctx, resetCmd)
+	if err != nil {
+		return err
+	}
+	if res.ExitCode != 0 {
+		return fmt.Errorf("reset command exited with %d: %s", res.ExitCode, res.Stderr.String())
+	}
+
+	return nil
+}
@@ -0,0 +1,29 @@
+package dkrlib
+
+import (
+	"context"
+	"time"
+)
+
+// Run の終わり (done) を待つ。Timeout を超えるか ctx が終わったら子 cgroup のプロセスを殺して終わらせる
+func waitRun(ctx context.Context, run *runCgroup, timeout time.Duration, done <-chan error) (bool, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case err := <-done:
+		return false, err
+	case <-expired:
+		run.kill()
+		<-done
+		return true, nil
+	case <-ctx.Done():
+		run.kill()
+		<-done
+		return false, ctx.Err()
+	}
+}
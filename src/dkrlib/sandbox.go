@@ -0,0 +1,93 @@
+package dkrlib
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/go-units"
+)
+
+// SandboxConfig ... ジャッジ用コンテナの隔離の設定。ゼロ値なら docker の既定のまま
+type SandboxConfig struct {
+	// コンテナをつなぐネットワーク。ジャッジとの通信だけを通す internal なネットワークを指定する。
+	// "none" にするとジャッジからも通信できなくなるので使わないこと
+	NetworkMode string
+
+	// ジャッジとコンテナクライアントがファイルを置く作業ディレクトリ。空なら "/"。
+	// "/" 以外なら書き込めるボリュームをマウントし、コンテナクライアントもここで動かす
+	WorkDir string
+
+	ReadonlyRootfs  bool              // ルートファイルシステムを読み取り専用にする。WorkDir を "/" 以外にすること
+	Tmpfs           map[string]string // tmpfs のマウント先 -> マウントオプション (例: "/tmp" -> "rw,exec,size=512m")。docker cp で書き込めないので WorkDir には使えない
+	CapDrop         []string          // 外す capability (例: "ALL")
+	CapAdd          []string          // CapDrop で外したあとに戻す capability
+	NoNewPrivileges bool              // setuid などで権限が増えないようにする
+	SeccompProfile  string            // seccomp プロファイル (JSON) の中身。空なら docker の既定
+	User            string            // コンテナ内でコマンドを実行するユーザ (例: "1000:1000")
+
+	FileSizeLimit  int64 // 作れるファイルの大きさの上限 (バイト)。0 なら制限しない
+	OpenFilesLimit int64 // 開けるファイルの数の上限。0 なら制限しない
+}
+
+func (sandbox SandboxConfig) workDir() string {
+	if sandbox.WorkDir == "" {
+		return "/"
+	}
+
+	return path.Clean(sandbox.WorkDir)
+}
+
+// Validate ... 組み合わせられない設定がないかを確かめる
+func (sandbox SandboxConfig) Validate() error {
+	workDir := sandbox.workDir()
+	if !path.IsAbs(workDir) {
+		return fmt.Errorf("work directory %q is not an absolute path", sandbox.WorkDir)
+	}
+	if sandbox.ReadonlyRootfs && workDir == "/" {
+		return fmt.Errorf("read-only root filesystem needs a work directory other than /")
+	}
+	for target := range sandbox.Tmpfs {
+		target = path.Clean(target)
+		if workDir == target || strings.HasPrefix(workDir, target+"/") {
+			return fmt.Errorf("work directory %s is on tmpfs %s, which docker cp cannot write to", workDir, target)
+		}
+	}
+
+	return nil
+}
+
+// apply ... 設定をコンテナの作成時の設定に反映する
+func (sandbox SandboxConfig) apply(config *container.Config, hostConfig *container.HostConfig) {
+	config.User = sandbox.User
+
+	if workDir := sandbox.workDir(); workDir != "/" {
+		config.WorkingDir = workDir
+		// 名前のないボリュームはコンテナを消すときに一緒に消える
+		hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{Type: mount.TypeVolume, Target: workDir})
+	}
+
+	if sandbox.NetworkMode != "" {
+		hostConfig.NetworkMode = container.NetworkMode(sandbox.NetworkMode)
+	}
+	hostConfig.ReadonlyRootfs = sandbox.ReadonlyRootfs
+	hostConfig.Tmpfs = sandbox.Tmpfs
+	hostConfig.CapDrop = sandbox.CapDrop
+	hostConfig.CapAdd = sandbox.CapAdd
+
+	if sandbox.NoNewPrivileges {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "no-new-privileges")
+	}
+	if sandbox.SeccompProfile != "" {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp="+sandbox.SeccompProfile)
+	}
+
+	if sandbox.FileSizeLimit > 0 {
+		hostConfig.Ulimits = append(hostConfig.Ulimits, &units.Ulimit{Name: "fsize", Soft: sandbox.FileSizeLimit, Hard: sandbox.FileSizeLimit})
+	}
+	if sandbox.OpenFilesLimit > 0 {
+		hostConfig.Ulimits = append(hostConfig.Ulimits, &units.Ulimit{Name: "nofile", Soft: sandbox.OpenFilesLimit, Hard: sandbox.OpenFilesLimit})
+	}
+}
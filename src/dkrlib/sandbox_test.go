@@ -0,0 +1,181 @@
+package dkrlib
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+)
+
+func TestSandboxConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  SandboxConfig
+		wantErr bool
+	}{
+		{name: "default", config: SandboxConfig{}},
+		{name: "work dir", config: SandboxConfig{WorkDir: "/judge"}},
+		{name: "readonly with work dir", config: SandboxConfig{WorkDir: "/judge", ReadonlyRootfs: true, Tmpfs: map[string]string{"/tmp": "rw,exec"}}},
+		{name: "readonly without work dir", config: SandboxConfig{ReadonlyRootfs: true}, wantErr: true},
+		{name: "readonly with root work dir", config: SandboxConfig{WorkDir: "/", ReadonlyRootfs: true}, wantErr: true},
+		{name: "relative work dir", config: SandboxConfig{WorkDir: "judge"}, wantErr: true},
+		{name: "work dir on tmpfs", config: SandboxConfig{WorkDir: "/judge", Tmpfs: map[string]string{"/judge": "rw,exec"}}, wantErr: true},
+		{name: "work dir under tmpfs", config: SandboxConfig{WorkDir: "/tmp/judge", Tmpfs: map[string]string{"/tmp/": "rw,exec"}}, wantErr: true},
+		{name: "tmpfs with same prefix", config: SandboxConfig{WorkDir: "/judge", Tmpfs: map[string]string{"/ju": "rw"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSandboxConfigApplyWorkDir(t *testing.T) {
+	tests := []struct {
+		name           string
+		workDir        string
+		wantWorkingDir string
+		wantMounts     []mount.Mount
+	}{
+		{name: "default", workDir: ""},
+		{name: "root", workDir: "/"},
+		{name: "work dir", workDir: "/judge/", wantWorkingDir: "/judge", wantMounts: []mount.Mount{{Type: mount.TypeVolume, Target: "/judge"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &container.Config{}
+			hostConfig := &container.HostConfig{}
+			SandboxConfig{WorkDir: tt.workDir, ReadonlyRootfs: true}.apply(config, hostConfig)
+
+			if config.WorkingDir != tt.wantWorkingDir {
+				t.Errorf("WorkingDir = %q, want %q", config.WorkingDir, tt.wantWorkingDir)
+			}
+			if len(hostConfig.Mounts) != len(tt.wantMounts) {
+				t.Fatalf("Mounts = %v, want %v", hostConfig.Mounts, tt.wantMounts)
+			}
+			for i := range tt.wantMounts {
+				if hostConfig.Mounts[i] != tt.wantMounts[i] {
+					t.Errorf("Mounts[%d] = %v, want %v", i, hostConfig.Mounts[i], tt.wantMounts[i])
+				}
+			}
+			if !hostConfig.ReadonlyRootfs {
+				t.Errorf("ReadonlyRootfs = false, want true")
+			}
+		})
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	tests := []struct {
+		dir  string
+		path string
+		want string
+	}{
+		{dir: "/", path: "userStdout.txt", want: "/userStdout.txt"},
+		{dir: "/judge", path: "userStdout.txt", want: "/judge/userStdout.txt"},
+		{dir: "/judge", path: "/testlib.h", want: "/testlib.h"},
+		{dir: "/judge", path: "../etc/passwd", want: "/etc/passwd"},
+		{dir: "/judge", path: "a/../b.txt", want: "/judge/b.txt"},
+	}
+
+	for _, tt := range tests {
+		if got := resolvePath(tt.dir, tt.path); got != tt.want {
+			t.Errorf("resolvePath(%q, %q) = %q, want %q", tt.dir, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestWriteTarInWorkDir(t *testing.T) {
+	tests := []struct {
+		name        string
+		workDir     string
+		dir         string
+		wantExtract string
+		wantNames   []string
+	}{
+		{name: "root", workDir: "/", dir: "/", wantExtract: "/", wantNames: []string{"main.cpp", "sub/a.txt"}},
+		{name: "work dir", workDir: "/judge", dir: "/judge", wantExtract: "/judge", wantNames: []string{"main.cpp", "sub/a.txt"}},
+		{name: "under work dir", workDir: "/judge", dir: "/judge/submission", wantExtract: "/judge", wantNames: []string{"submission/main.cpp", "submission/sub/a.txt"}},
+		{name: "outside work dir", workDir: "/judge", dir: "/judgement", wantExtract: "/", wantNames: []string{"judgement/main.cpp", "judgement/sub/a.txt"}},
+	}
+	files := []File{
+		{Path: "main.cpp", Content: []byte("int main() {}"), Mode: 0644},
+		{Path: "sub/a.txt", Content: []byte("a"), Mode: 0644},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extract := extractDir(tt.workDir, tt.dir)
+			if extract != tt.wantExtract {
+				t.Errorf("extractDir() = %q, want %q", extract, tt.wantExtract)
+			}
+
+			var buf bytes.Buffer
+			if err := writeTar(&buf, tt.dir, extract, files); err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			tr := tar.NewReader(&buf)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				names = append(names, header.Name)
+			}
+
+			if len(names) != len(tt.wantNames) {
+				t.Fatalf("names = %v, want %v", names, tt.wantNames)
+			}
+			for i := range names {
+				if names[i] != tt.wantNames[i] {
+					t.Errorf("names[%d] = %q, want %q", i, names[i], tt.wantNames[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWriteTarFromReader(t *testing.T) {
+	files := []File{
+		{Path: "answer.txt", Reader: strings.NewReader("1 2\n3\n"), Size: 6, Mode: 0644},
+		{Path: "short.txt", Reader: strings.NewReader("1"), Size: 2, Mode: 0644},
+	}
+
+	var buf bytes.Buffer
+	if err := writeTar(&buf, "/judge", "/judge", files[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&buf)
+	header, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Name != "answer.txt" || header.Size != 6 || string(content) != "1 2\n3\n" {
+		t.Errorf("entry = %q (%d bytes) %q, want %q (6 bytes) %q", header.Name, header.Size, content, "answer.txt", "1 2\n3\n")
+	}
+
+	// Reader が Size より短ければ壊れた tar を送らずにエラーにする
+	if err := writeTar(ioutil.Discard, "/judge", "/judge", files[1:]); err == nil {
+		t.Error("writeTar() with a short reader error = nil, want error")
+	}
+}
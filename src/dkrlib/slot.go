@@ -0,0 +1,135 @@
+package dkrlib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// CPU の割り当ての周期 (µs)。CPU の割り当て量 (CPUQuota) は CPUQuota にこれをかけたもの
+const cpuPeriod = 100000
+
+// Slot ... 並列に動くジャッジの枠。枠ごとに専用の CPU を割り当てて、実行時間が他のジャッジの負荷に左右されないようにする
+type Slot struct {
+	ID       int
+	CPUs     []int   // 割り当てる CPU の番号。空なら割り当てない
+	CPUQuota float64 // 使える CPU 時間を CPU 何個分にするか (docker の --cpus と同じ)。0 なら制限しない
+}
+
+// CpusetCpus ... docker の CpusetCpus の形式 ("0,1") にする
+func (slot Slot) CpusetCpus() string {
+	cpus := make([]string, len(slot.CPUs))
+	for i, cpu := range slot.CPUs {
+		cpus[i] = strconv.Itoa(cpu)
+	}
+
+	return strings.Join(cpus, ",")
+}
+
+// apply ... 枠の CPU と CPU の割り当て量を docker の Resources に反映する
+func (slot Slot) apply(resources *container.Resources) {
+	if len(slot.CPUs) > 0 {
+		resources.CpusetCpus = slot.CpusetCpus()
+	}
+	if slot.CPUQuota > 0 {
+		resources.CPUPeriod = cpuPeriod
+		resources.CPUQuota = slot.cpuQuota()
+	}
+}
+
+// 1 周期 (cpuPeriod) に使える CPU 時間 (µs)
+func (slot Slot) cpuQuota() int64 {
+	return int64(slot.CPUQuota * cpuPeriod)
+}
+
+// NewSlots ... n 個の枠を作り、cpus を先頭から cpusPerSlot 個ずつ割り当てる。
+// cpus が空なら CPU を割り当てない枠を作る。cpuQuota は各枠の CPU の割り当て量 (0 なら制限しない)
+func NewSlots(n int, cpus []int, cpusPerSlot int, cpuQuota float64) ([]Slot, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid number of slots: %d", n)
+	}
+	if cpuQuota < 0 {
+		return nil, fmt.Errorf("invalid cpu quota: %g", cpuQuota)
+	}
+	if len(cpus) > 0 && cpusPerSlot < 1 {
+		return nil, fmt.Errorf("invalid number of cpus per slot: %d", cpusPerSlot)
+	}
+	if len(cpus) < n*cpusPerSlot && len(cpus) > 0 {
+		return nil, fmt.Errorf("%d slots need %d cpus, but only %d cpus are given", n, n*cpusPerSlot, len(cpus))
+	}
+
+	slots := make([]Slot, n)
+	for i := range slots {
+		slots[i].ID = i
+		slots[i].CPUQuota = cpuQuota
+		if len(cpus) > 0 {
+			slots[i].CPUs = cpus[i*cpusPerSlot : (i+1)*cpusPerSlot]
+		}
+	}
+
+	return slots, nil
+}
+
+// NewCheckerSlot ... 問題のチェッカーとインタラクタを動かす枠を作る。提出の実行時間に影響しないように、
+// ジャッジの枠 slots のどれとも重ならない cpus を割り当てる。slots に CPU を割り当てていなければ cpus は空でよい
+func NewCheckerSlot(slots []Slot, cpus []int) (Slot, error) {
+	used := make(map[int]bool)
+	for _, slot := range slots {
+		for _, cpu := range slot.CPUs {
+			used[cpu] = true
+		}
+	}
+
+	if len(used) > 0 && len(cpus) == 0 {
+		return Slot{}, fmt.Errorf("checkers need cpus that are not assigned to judge slots")
+	}
+	for _, cpu := range cpus {
+		if used[cpu] {
+			return Slot{}, fmt.Errorf("cpu %d is assigned to both a judge slot and checkers", cpu)
+		}
+	}
+
+	return Slot{ID: len(slots), CPUs: cpus}, nil
+}
+
+// ParseCPUList ... "0-3,6" のような CPU の番号の一覧を読む
+func ParseCPUList(str string) ([]int, error) {
+	var cpus []int
+
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(str, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		first, last := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			first, last = part[:i], part[i+1:]
+		}
+
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu list %q: %w", str, err)
+		}
+		to, err := strconv.Atoi(last)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu list %q: %w", str, err)
+		}
+		if from < 0 || from > to {
+			return nil, fmt.Errorf("invalid cpu range %q", part)
+		}
+
+		for cpu := from; cpu <= to; cpu++ {
+			if seen[cpu] {
+				return nil, fmt.Errorf("cpu %d appears twice in %q", cpu, str)
+			}
+			seen[cpu] = true
+			cpus = append(cpus, cpu)
+		}
+	}
+
+	return cpus, nil
+}
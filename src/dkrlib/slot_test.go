@@ -0,0 +1,119 @@
+package dkrlib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestParseCPUList(t *testing.T) {
+	tests := []struct {
+		name    string
+		str     string
+		want    []int
+		wantErr bool
+	}{
+		{name: "single", str: "3", want: []int{3}},
+		{name: "range", str: "0-3", want: []int{0, 1, 2, 3}},
+		{name: "mixed", str: "0-1,4,6-7", want: []int{0, 1, 4, 6, 7}},
+		{name: "spaces and empty parts", str: " 0-1 , ,4,", want: []int{0, 1, 4}},
+		{name: "trailing newline", str: "0-1\n", want: []int{0, 1}},
+		{name: "empty", str: ""},
+		{name: "one cpu range", str: "2-2", want: []int{2}},
+		{name: "not a number", str: "a", wantErr: true},
+		{name: "reversed range", str: "3-1", wantErr: true},
+		{name: "negative", str: "-1", wantErr: true},
+		{name: "open range", str: "1-", wantErr: true},
+		{name: "double dash", str: "1--2", wantErr: true},
+		{name: "three parts", str: "1-2-3", wantErr: true},
+		{name: "duplicate", str: "0-2,1", wantErr: true},
+		{name: "spaces in range", str: "0 - 2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCPUList(tt.str)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCPUList(%q) error = %v, wantErr %v", tt.str, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseCPUList(%q) = %v, want %v", tt.str, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlotApply(t *testing.T) {
+	tests := []struct {
+		name       string
+		slot       Slot
+		wantCpuset string
+		wantPeriod int64
+		wantQuota  int64
+	}{
+		{name: "nothing", slot: Slot{}},
+		{name: "cpuset", slot: Slot{CPUs: []int{2, 3}}, wantCpuset: "2,3"},
+		{name: "cpuset and quota", slot: Slot{CPUs: []int{2}, CPUQuota: 0.9}, wantCpuset: "2", wantPeriod: 100000, wantQuota: 90000},
+		{name: "quota only", slot: Slot{CPUQuota: 2}, wantPeriod: 100000, wantQuota: 200000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resources container.Resources
+			tt.slot.apply(&resources)
+
+			if resources.CpusetCpus != tt.wantCpuset || resources.CPUPeriod != tt.wantPeriod || resources.CPUQuota != tt.wantQuota {
+				t.Errorf("apply() = cpuset %q, period %d, quota %d, want %q, %d, %d",
+					resources.CpusetCpus, resources.CPUPeriod, resources.CPUQuota, tt.wantCpuset, tt.wantPeriod, tt.wantQuota)
+			}
+		})
+	}
+}
+
+func TestNewSlots(t *testing.T) {
+	slots, err := NewSlots(2, []int{0, 1, 2, 3}, 2, 1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Slot{{ID: 0, CPUs: []int{0, 1}, CPUQuota: 1.5}, {ID: 1, CPUs: []int{2, 3}, CPUQuota: 1.5}}
+	if !reflect.DeepEqual(slots, want) {
+		t.Errorf("NewSlots() = %v, want %v", slots, want)
+	}
+
+	if _, err := NewSlots(2, []int{0, 1, 2}, 2, 0); err == nil {
+		t.Error("NewSlots() with too few cpus error = nil, want error")
+	}
+	if _, err := NewSlots(2, nil, 1, -1); err == nil {
+		t.Error("NewSlots() with a negative quota error = nil, want error")
+	}
+}
+
+func TestNewCheckerSlot(t *testing.T) {
+	pinned := []Slot{{ID: 0, CPUs: []int{0}}, {ID: 1, CPUs: []int{1}}}
+
+	tests := []struct {
+		name    string
+		slots   []Slot
+		cpus    []int
+		want    Slot
+		wantErr bool
+	}{
+		{name: "no pinning", slots: []Slot{{ID: 0}}, want: Slot{ID: 1}},
+		{name: "own cpus", slots: pinned, cpus: []int{2, 3}, want: Slot{ID: 2, CPUs: []int{2, 3}}},
+		{name: "no cpus for checkers", slots: pinned, wantErr: true},
+		{name: "shared cpu", slots: pinned, cpus: []int{1, 2}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewCheckerSlot(tt.slots, tt.cpus)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewCheckerSlot() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NewCheckerSlot() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
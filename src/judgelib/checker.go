@@ -0,0 +1,347 @@
+package judgelib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/checklib"
+	"github.com/cafecoder-dev/cafecoder-judge/src/cmdlib"
+	"github.com/cafecoder-dev/cafecoder-judge/src/dkrlib"
+	"github.com/cafecoder-dev/cafecoder-judge/src/types"
+	"github.com/cafecoder-dev/cafecoder-judge/src/util"
+)
+
+// 問題のチェッカー・インタラクタ (testlib.h 準拠) まわりの設定。
+// testlib.h はコンテナイメージの / に置いてある前提。コンパイルは WorkDir で行うので / をインクルードパスに加える
+const (
+	checkerName         = "checker"
+	interactorName      = "interactor"
+	judgeProgramCompile = "g++-10 %[1]s.cpp -O2 -std=gnu++17 -I / -o %[1]s.out"
+	judgeProgramCache   = "checker_cache"
+	checkerTimeout      = 10 * time.Second
+	checkerMessageLimit = 1024
+	judgeProgramLimit   = 64 * 1024 * 1024  // チェッカー・インタラクタのソースとコンパイルしたものの大きさの上限 (バイト)
+	judgeInputLimit     = 256 * 1024 * 1024 // ホストに読み出すテストケースと想定解の大きさの上限 (バイト)
+	judgeStderrLimit    = 64 * 1024         // ホストで受け取るインタラクタの標準エラー出力の上限 (バイト)
+)
+
+// コンパイル済みチェッカーのキャッシュのキーごとのロック。
+// 同じソースのチェッカーを並列にコンパイルしないようにする。
+var checkerLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: make(map[string]*sync.Mutex)}
+
+func checkerLock(key string) *sync.Mutex {
+	checkerLocks.Lock()
+	defer checkerLocks.Unlock()
+
+	if _, exist := checkerLocks.locks[key]; !exist {
+		checkerLocks.locks[key] = &sync.Mutex{}
+	}
+
+	return checkerLocks.locks[key]
+}
+
+// prepareJudgeProgram ... 問題のチェッカーやインタラクタ (name) を judgeBox に <name>.out として配置する。
+// judgeBox は提出を動かしたことのない Sandbox (Pool.CheckoutNew) を使うこと。
+// ソースの中身とコンパイルのコマンド、イメージのハッシュでコンパイル済みのものをホストにキャッシュし、なければ judgeBox でコンパイルしてキャッシュする
+func prepareJudgeProgram(ctx context.Context, submitID string, judgeBox dkrlib.Sandbox, name string, sourcePath string) error {
+	if sourcePath == "" {
+		return fmt.Errorf("%s source path is empty", name)
+	}
+
+	sourceFilename := name + ".cpp"
+	binaryFilename := name + ".out"
+
+	recv, err := cmdlib.RequestCmd(
+		ctx,
+		types.RequestJSON{
+			Mode:      "download",
+			SessionID: submitID,
+			Filename:  sourceFilename,
+			CodePath:  sourcePath,
+		},
+		judgeBox.Address(),
+		judgeBox.Token(),
+	)
+	if err != nil {
+		return err
+	}
+	if !recv.Result {
+		return fmt.Errorf("%s download failed: %s", name, recv.ErrMessage)
+	}
+
+	source, err := dkrlib.ReadFile(ctx, judgeBox, sourceFilename, judgeProgramLimit)
+	if err != nil {
+		return err
+	}
+	compileCmd := fmt.Sprintf(judgeProgramCompile, name)
+	hash := sha256.New()
+	for _, part := range [][]byte{source, []byte(compileCmd), []byte(judgeBox.Image())} {
+		hash.Write(part)
+		hash.Write([]byte{0})
+	}
+	key := name + "-" + hex.EncodeToString(hash.Sum(nil))
+	cachePath := filepath.Join(judgeProgramCache, key)
+
+	lock := checkerLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if binary, err := ioutil.ReadFile(cachePath); err == nil {
+		return judgeBox.CopyIn(ctx, binary, binaryFilename, 0755)
+	}
+
+	compileCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	compileRes, err := judgeBox.Exec(compileCtx, []string{"sh", "-c", compileCmd})
+	if err != nil {
+		return err
+	}
+	if compileRes.ExitCode != 0 {
+		return fmt.Errorf("%s compile failed: %s", name, compileRes.Stderr.String())
+	}
+
+	binary, err := dkrlib.ReadFile(ctx, judgeBox, binaryFilename, judgeProgramLimit)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(judgeProgramCache, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(judgeProgramCache, key+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), cachePath)
+}
+
+// judgeFiles ... 1 つのテストケースの判定に使うファイル。メモリに載せないように、ホストの一時ディレクトリ dir に
+// コンテナと同じ名前 (testcasePath, userOutputPath, answerPath) で置く。
+// ホストで実行するときは、ユーザのプログラムが書き換えられないように、想定解は実行する前にホストに読み出しておく
+type judgeFiles struct {
+	dir        string
+	outputSize int64 // outputLimit を超えていれば、ユーザの出力は途中までしか置いていない
+}
+
+// newJudgeFiles ... ファイルを置く一時ディレクトリを作る。テストケースごとに read で置き直し、使い終わったら remove すること
+func newJudgeFiles() (*judgeFiles, error) {
+	dir, err := ioutil.TempDir("", "cafecoder-judge")
+	if err != nil {
+		return nil, err
+	}
+
+	return &judgeFiles{dir: dir}, nil
+}
+
+func (files *judgeFiles) remove() {
+	if err := os.RemoveAll(files.dir); err != nil {
+		fmt.Printf("remove %s: %s\n", files.dir, err)
+	}
+}
+
+func (files *judgeFiles) path(name string) string {
+	return filepath.Join(files.dir, name)
+}
+
+// read ... コンテナクライアントが置いた想定解 (withTestcase ならテストケースも) を読み出し、
+// ユーザのプログラムから読めないように想定解をコンテナから消す。前のテストケースのファイルは置き換える
+func (files *judgeFiles) read(ctx context.Context, container dkrlib.Sandbox, withTestcase bool) error {
+	files.outputSize = 0
+	if err := ioutil.WriteFile(files.path(userOutputPath), nil, 0644); err != nil {
+		return err
+	}
+
+	if _, err := files.copyOut(ctx, container, answerPath, judgeInputLimit); err != nil {
+		return err
+	}
+	if withTestcase {
+		if _, err := files.copyOut(ctx, container, testcasePath, judgeInputLimit); err != nil {
+			return err
+		}
+	} else if err := ioutil.WriteFile(files.path(testcasePath), nil, 0644); err != nil {
+		return err
+	}
+
+	return removeFiles(ctx, container, answerPath)
+}
+
+// コンテナの name を同じ名前でホストに書き出し、大きさを返す。maxBytes バイトを超えていれば dkrlib.ErrSizeLimit
+func (files *judgeFiles) copyOut(ctx context.Context, container dkrlib.Sandbox, name string, maxBytes int64) (int64, error) {
+	reader, err := container.CopyOut(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	file, err := os.Create(files.path(name))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	size, err := io.Copy(file, io.LimitReader(reader, maxBytes+1))
+	if err != nil {
+		return 0, err
+	}
+	if size > maxBytes {
+		return 0, dkrlib.ErrSizeLimit
+	}
+
+	return size, file.Close()
+}
+
+// readUserOutput ... コンテナクライアントが実行したときのユーザの出力を読み出す
+func (files *judgeFiles) readUserOutput(ctx context.Context, container dkrlib.Sandbox, stdoutSize int64) error {
+	files.outputSize = stdoutSize
+	if stdoutSize > outputLimit {
+		return nil
+	}
+
+	size, err := files.copyOut(ctx, container, userOutputPath, outputLimit)
+	if err == dkrlib.ErrSizeLimit {
+		files.outputSize = outputLimit + 1
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	files.outputSize = size
+
+	return nil
+}
+
+// judgeBox に testlib.h の引数で渡すファイルとして置く
+func (files *judgeFiles) copyTo(ctx context.Context, judgeBox dkrlib.Sandbox) error {
+	var copies []dkrlib.File
+	for _, name := range []string{testcasePath, userOutputPath, answerPath} {
+		file, err := os.Open(files.path(name))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		copies = append(copies, dkrlib.File{Path: name, Reader: file, Size: info.Size(), Mode: 0644})
+	}
+
+	return judgeBox.CopyFilesIn(ctx, ".", copies)
+}
+
+func (files *judgeFiles) UserOutput(ctx context.Context) (io.ReadCloser, error) {
+	return os.Open(files.path(userOutputPath))
+}
+
+func (files *judgeFiles) Answer(ctx context.Context) (io.ReadCloser, error) {
+	return os.Open(files.path(answerPath))
+}
+
+// コンテナ内のファイルを消す
+func removeFiles(ctx context.Context, container dkrlib.Sandbox, paths ...string) error {
+	res, err := container.Exec(ctx, append([]string{"rm", "-f"}, paths...))
+	if err != nil {
+		return err
+	}
+	if res.ExitCode != 0 {
+		return fmt.Errorf("failed to remove %v: %s", paths, res.Stderr.String())
+	}
+
+	return nil
+}
+
+// judgeBox で問題のチェッカーを実行する checklib.Runner。判定するファイルは check が置く
+type judgeBoxRunner struct {
+	judgeBox dkrlib.Sandbox
+}
+
+func (runner judgeBoxRunner) RunChecker(ctx context.Context) (int, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, checkerTimeout)
+	defer cancel()
+
+	// testlib.h の引数の順番は <input> <output> <answer>
+	res, err := runner.judgeBox.Exec(ctx, []string{"./" + checkerName + ".out", testcasePath, userOutputPath, answerPath})
+	if err != nil {
+		return 0, "", err
+	}
+
+	return res.ExitCode, res.Stderr.String(), nil
+}
+
+// newChecker ... 問題の設定からチェッカーを選ぶ。問題のチェッカーは judgeBox で動かす
+func newChecker(judgeBox dkrlib.Sandbox, problem types.ProblemsGORM) (checklib.Checker, error) {
+	return checklib.New(problem.Checker, checklib.Options{
+		AbsoluteError: problem.AbsoluteError,
+		RelativeError: problem.RelativeError,
+		Runner:        judgeBoxRunner{judgeBox: judgeBox},
+	})
+}
+
+// check ... ホストに読み出した出力をチェッカーで判定する。
+// 正常に実行が終わったもの (判定が AC か WA) だけが対象。出力が outputLimit を超えていれば OLE にする。
+// judgeBox があれば (問題のチェッカーを使うとき) 判定するファイルをそこに置く
+func check(ctx context.Context, judgeBox dkrlib.Sandbox, checker checklib.Checker, files *judgeFiles, testcaseResults types.TestcaseResultsGORM) (types.TestcaseResultsGORM, error) {
+	if testcaseResults.Status != "AC" && testcaseResults.Status != "WA" {
+		return testcaseResults, nil
+	}
+
+	if files.outputSize > outputLimit {
+		return applyCheckResult(testcaseResults, checklib.Result{Status: "OLE"}), nil
+	}
+
+	if judgeBox != nil {
+		if err := files.copyTo(ctx, judgeBox); err != nil {
+			return testcaseResults, err
+		}
+	}
+
+	result, err := checker.Check(ctx, files)
+	if err != nil {
+		return testcaseResults, err
+	}
+
+	return applyCheckResult(testcaseResults, result), nil
+}
+
+// チェッカーの判定をテストケースの結果に反映する
+func applyCheckResult(testcaseResults types.TestcaseResultsGORM, result checklib.Result) types.TestcaseResultsGORM {
+	testcaseResults.Status = result.Status
+	testcaseResults.Score = result.Score
+	testcaseResults.CheckerMessage = util.TruncateString(util.SanitizeString(result.Message), checkerMessageLimit)
+
+	testcaseResults.MismatchLine = 0
+	testcaseResults.MismatchToken = 0
+	testcaseResults.MismatchExpected = ""
+	testcaseResults.MismatchActual = ""
+	if result.Mismatch != nil {
+		testcaseResults.MismatchLine = result.Mismatch.Line
+		testcaseResults.MismatchToken = result.Mismatch.Token
+		testcaseResults.MismatchExpected = result.Mismatch.Expected
+		testcaseResults.MismatchActual = result.Mismatch.Actual
+	}
+
+	return testcaseResults
+}
@@ -0,0 +1,125 @@
+package judgelib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/dkrlib"
+	"github.com/cafecoder-dev/cafecoder-judge/src/types"
+)
+
+// ホストで実行するときの入力のリダイレクト。出力はホストで受け取る
+const meteredRedirect = "< testcase.txt"
+
+// ホストで資源の使用量を測れるか。最初のジャッジで一度だけ試して覚えておく
+var hostMeter = struct {
+	sync.Mutex
+	checked   bool
+	supported bool
+}{}
+
+// canMeter ... Sandbox.Run で実行したプロセスだけの資源の使用量を測れるか。
+// 測れない環境ではコンテナクライアントに実行させ、その申告をそのまま使う
+func canMeter(ctx context.Context, container dkrlib.Sandbox) (bool, error) {
+	hostMeter.Lock()
+	defer hostMeter.Unlock()
+
+	if hostMeter.checked {
+		return hostMeter.supported, nil
+	}
+
+	_, err := container.Run(ctx, []string{"true"}, dkrlib.RunOptions{})
+	if err == dkrlib.ErrMeterUnsupported {
+		fmt.Println("cgroup stats are not available, use execution time and memory reported by containers")
+		hostMeter.checked = true
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	hostMeter.checked = true
+	hostMeter.supported = true
+
+	return true, nil
+}
+
+// executeSubmission ... ユーザのプログラムをテストケース 1 つについて Sandbox.Run で実行する。
+// execution_time はユーザのプログラムとその子孫の CPU 時間 (ms)、execution_memory はメモリ使用量の最大値 (KB)。
+// 出力はホストで受け取って files に入れる
+func executeSubmission(ctx context.Context, container dkrlib.Sandbox, executeCmd string, timeLimit int, files *judgeFiles, testcaseResults types.TestcaseResultsGORM) (types.TestcaseResultsGORM, error) {
+	cmd := strings.Replace(executeCmd, executeRedirect, meteredRedirect, 1)
+
+	output, err := os.Create(files.path(userOutputPath))
+	if err != nil {
+		return testcaseResults, err
+	}
+	defer output.Close()
+	stdout := &limitedWriter{writer: output, limit: outputLimit}
+
+	res, err := container.Run(ctx, []string{"sh", "-c", cmd}, dkrlib.RunOptions{
+		Stdout:  stdout,
+		Timeout: time.Duration(timeLimit*2+1000) * time.Millisecond,
+	})
+	if err != nil {
+		return testcaseResults, err
+	}
+	if stdout.err != nil {
+		return testcaseResults, stdout.err
+	}
+
+	testcaseResults.ExecutionTime = int(res.Usage.CPUTime / time.Millisecond)
+	testcaseResults.ExecutionMemory = int(res.Usage.MemoryPeak / 1024)
+	testcaseResults.Score = 0
+
+	switch {
+	case res.TimedOut:
+		testcaseResults.Status = "TLE"
+	case res.OOMKilled:
+		testcaseResults.Status = "MLE"
+	case stdout.exceeded:
+		testcaseResults.Status = "OLE"
+	case res.ExitCode != 0:
+		testcaseResults.Status = "RE"
+	default:
+		testcaseResults.Status = "AC"
+	}
+
+	files.outputSize = stdout.written
+	if stdout.exceeded {
+		files.outputSize = outputLimit + 1
+	}
+
+	return testcaseResults, output.Close()
+}
+
+// limit バイトまでを writer に書く io.Writer。超えた分は捨てて exceeded を立てる。
+// 書き込みを失敗させるとユーザのプログラムが出力できずに止まるので、writer への書き込みのエラーも err に覚えて最後まで受け取る
+type limitedWriter struct {
+	writer   io.Writer
+	limit    int64
+	written  int64
+	exceeded bool
+	err      error
+}
+
+func (limited *limitedWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if remain := limited.limit - limited.written; int64(len(p)) > remain {
+		limited.exceeded = true
+		p = p[:remain]
+	}
+
+	if limited.err == nil && len(p) > 0 {
+		var written int
+		written, limited.err = limited.writer.Write(p)
+		limited.written += int64(written)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,134 @@
+package judgelib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/checklib"
+	"github.com/cafecoder-dev/cafecoder-judge/src/dkrlib"
+	"github.com/cafecoder-dev/cafecoder-judge/src/types"
+)
+
+// 実行コマンドの入出力のリダイレクト。インタラクティブ問題では取り除いて、標準入出力をインタラクタにつなぐ
+const executeRedirect = "< testcase.txt > userStdout.txt"
+
+// runInteractive ... ユーザのプログラムを container で、インタラクタを judgeBox で実行し、ジャッジが標準入出力を中継して対話させる。
+// インタラクタとテストケース・想定解はユーザのプログラムから触れない judgeBox にだけ置き、インタラクタの判定を結果に反映する。
+// execution_time と execution_memory はユーザのプログラムだけを測ったもの
+func runInteractive(ctx context.Context, container dkrlib.Sandbox, judgeBox dkrlib.Sandbox, files *judgeFiles, executeCmd string, timeLimit int, testcaseResults types.TestcaseResultsGORM) (types.TestcaseResultsGORM, error) {
+	if !strings.Contains(executeCmd, executeRedirect) {
+		return testcaseResults, errors.New("execute_cmd does not support interactive problems")
+	}
+	cmd := strings.Replace(executeCmd, executeRedirect, "", 1)
+
+	// テストケースと想定解は judgeBox にだけ置く
+	if err := removeFiles(ctx, container, testcasePath); err != nil {
+		return testcaseResults, err
+	}
+	if err := files.copyTo(ctx, judgeBox); err != nil {
+		return testcaseResults, err
+	}
+
+	// 待ち続けている状態を検出するための実時間の制限。
+	// インタラクタは少し長くして、ユーザのプログラムが先に打ち切られて TLE になるようにする
+	wallLimit := time.Duration(timeLimit*2+1000) * time.Millisecond
+	interactorWallLimit := wallLimit + time.Second
+
+	toUserReader, toUserWriter := io.Pipe()
+	fromUserReader, fromUserWriter := io.Pipe()
+	var interactorStderr bytes.Buffer
+
+	var (
+		wg                   sync.WaitGroup
+		userRes, judgeRes    *dkrlib.RunResult
+		userErr, interactErr error
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		userRes, userErr = container.Run(ctx, []string{"sh", "-c", cmd}, dkrlib.RunOptions{
+			Stdin:   toUserReader,
+			Stdout:  &relayWriter{writer: fromUserWriter},
+			Timeout: wallLimit,
+		})
+		// 相手が読み書きを待ち続けないように、ユーザのプログラムが終わったら両方向を閉じる
+		fromUserWriter.Close()
+		toUserReader.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		judgeRes, interactErr = judgeBox.Run(ctx, []string{"./" + interactorName + ".out", testcasePath, "interactorOutput.txt", answerPath}, dkrlib.RunOptions{
+			Stdin:   fromUserReader,
+			Stdout:  &relayWriter{writer: toUserWriter},
+			Stderr:  &limitedWriter{writer: &interactorStderr, limit: judgeStderrLimit},
+			Timeout: interactorWallLimit,
+		})
+		toUserWriter.Close()
+		fromUserReader.Close()
+	}()
+	wg.Wait()
+
+	if userErr == dkrlib.ErrMeterUnsupported || interactErr == dkrlib.ErrMeterUnsupported {
+		return testcaseResults, errors.New("interactive problems require cgroup stats on the judge host")
+	}
+	if userErr != nil {
+		return testcaseResults, userErr
+	}
+	if interactErr != nil {
+		return testcaseResults, interactErr
+	}
+
+	testcaseResults.ExecutionTime = int(userRes.Usage.CPUTime / time.Millisecond)
+	testcaseResults.ExecutionMemory = int(userRes.Usage.MemoryPeak / 1024)
+
+	switch {
+	case userRes.TimedOut || testcaseResults.ExecutionTime > timeLimit:
+		// ユーザのプログラムが終わらなかった
+		testcaseResults.Status = "TLE"
+		testcaseResults.Score = 0
+		return testcaseResults, nil
+	case userRes.OOMKilled:
+		testcaseResults.Status = "MLE"
+		testcaseResults.Score = 0
+		return testcaseResults, nil
+	case judgeRes.TimedOut:
+		// ユーザのプログラムは終わったが、インタラクタが入力を待ち続けた
+		testcaseResults.Status = "WA"
+		testcaseResults.Score = 0
+		return testcaseResults, nil
+	}
+
+	result, err := checklib.TestlibResult(judgeRes.ExitCode, interactorStderr.String())
+	if err != nil {
+		return testcaseResults, err
+	}
+	testcaseResults = applyCheckResult(testcaseResults, result)
+
+	// インタラクタが正解と判定しても、ユーザのプログラムが異常終了していれば RE
+	if testcaseResults.Status == "AC" && userRes.ExitCode != 0 {
+		testcaseResults.Status = "RE"
+		testcaseResults.Score = 0
+	}
+
+	return testcaseResults, nil
+}
+
+// 相手が先に終わって書けなくなったあとの出力を捨てる io.Writer。
+// 書き込みを失敗させると Run が出力を受け取れずにエラーになるので、常に成功したことにする
+type relayWriter struct {
+	writer io.Writer
+	err    error
+}
+
+func (relay *relayWriter) Write(p []byte) (int, error) {
+	if relay.err == nil {
+		_, relay.err = relay.writer.Write(p)
+	}
+
+	return len(p), nil
+}
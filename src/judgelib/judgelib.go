@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -18,97 +19,211 @@ import (
 	"github.com/cafecoder-dev/cafecoder-judge/src/util"
 )
 
-var priorityMap = map[string]int{"-": 0, "AC": 2, "TLE": 3, "MLE": 4, "OLE": 5, "WA": 6, "RE": 7, "CE": 8, "IE": 9}
+// 問題に実行時間制限 (ms) が設定されていないときの既定値。言語ごとの倍率・加算分はこれに適用される
+const defaultTimeLimit = 2000
 
-// Judge ... ジャッジのフロー
-func Judge(submits types.SubmitsGORM, cmdChickets *cmdlib.CmdTicket) {
-	result := types.ResultGORM{Status: "-"}
+// コンテナ内のテストケース、ユーザの出力と想定解のパス。Sandbox の WorkDir からの相対パス
+const (
+	testcasePath   = "testcase.txt"
+	userOutputPath = "userStdout.txt"
+	answerPath     = "answer.txt"
+)
+
+// ユーザの出力の上限 (バイト)。超えたら OLE
+const outputLimit = 64 * 1024 * 1024
+
+// 判定の優先度。テストケースごとの判定のうち、優先度が最も高いものを提出の判定にする
+var priorityMap = map[string]int{"-": 0, "AC": 2, "TLE": 3, "MLE": 4, "OLE": 5, "PE": 6, "WA": 7, "RE": 8, "CE": 9, "IE": 10}
 
-	ctx := context.Background()
+// Judge ... ジャッジのフロー。提出は枠 slot の CPU で、問題のチェッカー・インタラクタは checkerSlot の CPU で動かす。
+// ctx が終わったら (提出の削除、リジャッジの要求、ジャッジの終了) 実行中の処理を打ち切り、結果を書き込まずにコンテナを破棄する
+func Judge(ctx context.Context, submits types.SubmitsGORM, pool *dkrlib.Pool, slot dkrlib.Slot, checkerSlot dkrlib.Slot) {
+	result := types.ResultGORM{Status: "-"}
 
 	if !util.ValidationCheck(submits) {
 		result.Status = "IE"
-		sendResult(submits, result)
+		sendResult(ctx, submits, result)
 		return
 	}
 
 	id := fmt.Sprintf("%d", submits.ID) // submit.info.ID を文字列に変換
-	(*cmdChickets).Lock()
-	sessionIDChan := (*cmdChickets).Channel[id]
-	(*cmdChickets).Unlock()
-
-	defer func() {
-		(*cmdChickets).Lock()
-		delete((*cmdChickets).Channel, id)
-		(*cmdChickets).Unlock()
-	}()
 
-	//containerName := util.MakeStringHash(id)
-	containerName := util.GenRandomString(32)
-
-	container, err := dkrlib.CreateContainer(ctx, containerName)
+	problem, err := fetchProblem(submits.ProblemID)
 	if err != nil {
 		fmt.Printf("%s\n", err.Error())
 		result.Status = "IE"
-		sendResult(submits, result)
+		sendResult(ctx, submits, result)
 		return
 	}
-	defer container.RemoveContainer(ctx)
 
-	langConfig, err := langconf.LangConfig(submits.Lang)
+	// 言語設定はここで一度だけ取得し、以降の設定の再読み込みの影響を受けないようにする。
+	// 出力のみの問題では提出の言語は使わない
+	langConfig := outputOnlyLangConfig
+	if problem.ProblemType != "output_only" {
+		langConfig, err = langconf.LangConfig(submits.Lang)
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			result.Status = "IE"
+			sendResult(ctx, submits, result)
+			return
+		}
+	}
+	timeLimit, memoryLimit := limits(problem, langConfig)
+
+	container, err := pool.Checkout(ctx, langConfig.ImageRef(dkrlib.DefaultImage), memoryLimit, slot)
 	if err != nil {
 		fmt.Printf("%s\n", err.Error())
 		result.Status = "IE"
-		sendResult(submits, result)
+		sendResult(ctx, submits, result)
 		return
 	}
+	// IE になったときや打ち切ったときはコンテナの状態がわからないので使い回さない
+	defer func() {
+		pool.Return(ctx, container, result.Status == "IE" || ctx.Err() != nil)
+	}()
 
 	recv, err := cmdlib.RequestCmd(
+		ctx,
 		types.RequestJSON{
 			Mode:      "download",
 			SessionID: fmt.Sprintf("%d", submits.ID),
 			Filename:  langConfig.FileName,
 			CodePath:  submits.Path,
 		},
-		container.IPAddress,
-		&sessionIDChan,
+		container.Address(),
+		container.Token(),
 	)
+	if err == nil && recv.Timeout {
+		err = errors.New("container did not respond to download")
+	}
 	if err != nil || !recv.Result {
-		fmt.Printf("%s\n", err.Error())
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+		}
 		fmt.Printf("%s\n", recv.ErrMessage)
 		result.Status = "IE"
-		sendResult(submits, result)
+		sendResult(ctx, submits, result)
 		return
 	}
 
-	compileRes, err := compile(fmt.Sprintf("%d", submits.ID), container.IPAddress, langConfig, &sessionIDChan)
-	if err != nil {
-		fmt.Printf("%s\n", err.Error())
-		result.Status = "IE"
-		sendResult(submits, result)
-		return
+	if problem.ProblemType != "output_only" {
+		compileRes, err := compile(ctx, fmt.Sprintf("%d", submits.ID), container, langConfig)
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			result.Status = "IE"
+			sendResult(ctx, submits, result)
+			return
+		}
+		if !compileRes.Result {
+			result.Status = "CE"
+			result.CompileError = util.SanitizeString(compileRes.ErrMessage)
+			sendResult(ctx, submits, result)
+			return
+		}
 	}
-	if !compileRes.Result {
-		result.Status = "CE"
-		result.CompileError = compileRes.ErrMessage
-		sendResult(submits, result)
-		return
+
+	// 問題のチェッカーとインタラクタは、提出に触られないように新しく作った別の Sandbox (judgeBox) で動かす
+	var judgeBox dkrlib.Sandbox
+	if problem.Checker == "custom" || problem.ProblemType == "interactive" {
+		judgeBox, err = pool.CheckoutNew(ctx, dkrlib.DefaultImage, dkrlib.DefaultMemoryLimit, checkerSlot)
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			result.Status = "IE"
+			sendResult(ctx, submits, result)
+			return
+		}
+		// テストケースと想定解を置いたので使い回さない
+		defer pool.Return(ctx, judgeBox, true)
+	}
+
+	if problem.Checker == "custom" {
+		if err := prepareJudgeProgram(ctx, id, judgeBox, checkerName, problem.CheckerPath); err != nil {
+			fmt.Printf("%s\n", err.Error())
+			result.Status = "IE"
+			sendResult(ctx, submits, result)
+			return
+		}
+	}
+	if problem.ProblemType == "interactive" {
+		if err := prepareJudgeProgram(ctx, id, judgeBox, interactorName, problem.InteractorPath); err != nil {
+			fmt.Printf("%s\n", err.Error())
+			result.Status = "IE"
+			sendResult(ctx, submits, result)
+			return
+		}
 	}
 
-	result, err = tryTestcase(ctx, submits, langConfig, container.IPAddress, &sessionIDChan)
+	result, err = tryTestcase(ctx, submits, problem, langConfig, timeLimit, memoryLimit, container, judgeBox)
 	if err != nil {
 		fmt.Printf("%s\n", err.Error())
 		result.Status = "IE"
-		sendResult(submits, result)
+		sendResult(ctx, submits, result)
 		return
 	}
 
-	sendResult(submits, result)
+	sendResult(ctx, submits, result)
+}
+
+func fetchProblem(problemID int64) (types.ProblemsGORM, error) {
+	var problem types.ProblemsGORM
+
+	db, err := sqllib.NewDB()
+	if err != nil {
+		return problem, err
+	}
+	defer db.Close()
+
+	err = db.
+		Table("problems").
+		Where("id = ? AND deleted_at IS NULL", problemID).
+		First(&problem).
+		Error
+
+	return problem, err
 }
 
-// 最終的な結果を DB に投げる。
-func sendResult(submits types.SubmitsGORM, result types.ResultGORM) {
-	if priorityMap[result.Status] <= 7 {
+// 問題の制限に言語ごとの設定を適用した実行時間制限 (ms) とメモリ制限 (MiB) を返す
+func limits(problem types.ProblemsGORM, langConfig langconf.LanguageConfig) (int, int) {
+	timeLimit := problem.ExecutionTimeLimit
+	if timeLimit <= 0 {
+		timeLimit = defaultTimeLimit
+	}
+
+	memoryLimit := problem.MemoryLimit
+	if memoryLimit <= 0 {
+		memoryLimit = dkrlib.DefaultMemoryLimit
+	}
+
+	return langConfig.TimeLimit(timeLimit), langConfig.MemLimit(memoryLimit)
+}
+
+// コンテナが返したテストケースの結果に制限超過を反映する。
+// execution_time は ms、execution_memory は KB。
+func applyLimits(testcaseResults types.TestcaseResultsGORM, timeLimit int, memoryLimit int) types.TestcaseResultsGORM {
+	if testcaseResults.Status != "AC" && testcaseResults.Status != "WA" && testcaseResults.Status != "PE" {
+		return testcaseResults
+	}
+
+	if testcaseResults.ExecutionMemory > memoryLimit*1024 {
+		testcaseResults.Status = "MLE"
+		testcaseResults.Score = 0
+	} else if testcaseResults.ExecutionTime > timeLimit {
+		testcaseResults.Status = "TLE"
+		testcaseResults.Score = 0
+	}
+
+	return testcaseResults
+}
+
+// 最終的な結果を DB に投げる。ctx が終わっていたら打ち切ったジャッジなので、途中の結果を消して WJ に戻す
+func sendResult(ctx context.Context, submits types.SubmitsGORM, result types.ResultGORM) {
+	if ctx.Err() != nil {
+		fmt.Printf("submit %d: judge canceled: %s\n", submits.ID, ctx.Err())
+		requeue(submits)
+		return
+	}
+
+	if priorityMap[result.Status] <= priorityMap["RE"] {
 		for _, elem := range result.TestcaseResultsMap {
 			if elem.ExecutionTime > result.ExecutionTime {
 				result.ExecutionTime = elem.ExecutionTime
@@ -122,55 +237,92 @@ func sendResult(submits types.SubmitsGORM, result types.ResultGORM) {
 	db, err := sqllib.NewDB()
 	if err != nil {
 		fmt.Println(err.Error())
+		return
 	}
 	defer db.Close()
 
 	result.Point = int(scoring(submits, result))
 
-	db.
+	columns := map[string]interface{}{
+		"status":           result.Status,
+		"execution_time":   result.ExecutionTime,
+		"execution_memory": result.ExecutionMemory,
+		"point":            result.Point,
+	}
+	if result.Status == "CE" {
+		columns["execution_memory"] = gorm.Expr("NULL")
+		columns["execution_time"] = gorm.Expr("NULL")
+		columns["compile_error"] = result.CompileError
+	}
+
+	if err := db.
 		Table("submits").
 		Where("id=? AND deleted_at IS NULL", submits.ID).
-		Update("status", result.Status).
-		Update("execution_time", result.ExecutionTime).
-		Update("execution_memory", result.ExecutionMemory).
-		Update("point", result.Point)
+		Updates(columns).
+		Error; err != nil {
+		fmt.Printf("submit %d: write result: %s\n", submits.ID, err)
+	}
+}
 
-	if result.Status == "CE" {
-		db.
-			Table("submits").
-			Where("id=? AND deleted_at IS NULL", submits.ID).
-			Update("execution_memory", gorm.Expr("NULL")).
-			Update("execution_time", gorm.Expr("NULL")).
-			Update("compile_error", result.CompileError)
+// ジャッジ中に書いた status と testcase_results を取り消して、次に WJ としてジャッジし直させる。
+// 打ち切りの間にリジャッジが要求されて WR になっていれば、その要求を消さないように WR のまま残す
+func requeue(submits types.SubmitsGORM) {
+	db, err := sqllib.NewDB()
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer db.Close()
+
+	if err := db.
+		Table("testcase_results").
+		Where("submit_id = ? AND deleted_at IS NULL", submits.ID).
+		Update("deleted_at", util.TimeToString(time.Now())).
+		Error; err != nil {
+		fmt.Printf("submit %d: delete partial testcase results: %s\n", submits.ID, err)
+	}
+	if err := db.
+		Table("submits").
+		Where("id = ? AND status <> 'WR' AND deleted_at IS NULL", submits.ID).
+		Update("status", "WJ").
+		Error; err != nil {
+		fmt.Printf("submit %d: reset status: %s\n", submits.ID, err)
 	}
 }
 
-func compile(submitID string, containerIPAddress string, langConfig langconf.LanguageConfig, sessionIDchan *chan types.CmdResultJSON) (types.CmdResultJSON, error) {
+func compile(ctx context.Context, submitID string, container dkrlib.Sandbox, langConfig langconf.LanguageConfig) (types.CmdResultJSON, error) {
 	recv, err := cmdlib.RequestCmd(
+		ctx,
 		types.RequestJSON{
 			Mode:      "compile",
 			Cmd:       langConfig.CompileCmd,
 			SessionID: submitID,
 			Filename:  langConfig.FileName,
 		},
-		containerIPAddress,
-		sessionIDchan,
+		container.Address(),
+		container.Token(),
 	)
 	if err != nil {
 		return types.CmdResultJSON{}, err
 	}
+	if recv.Timeout {
+		return types.CmdResultJSON{}, errors.New("container did not respond to compile")
+	}
 
 	fmt.Println("Compile Result: ", recv)
 
-	time.Sleep(2 * time.Second)
+	select {
+	case <-time.After(2 * time.Second):
+	case <-ctx.Done():
+		return types.CmdResultJSON{}, ctx.Err()
+	}
 
 	return recv, nil
 }
 
-func tryTestcase(ctx context.Context, submits types.SubmitsGORM, langConfig langconf.LanguageConfig, containerIPAddress string, sessionIDChan *chan types.CmdResultJSON) (types.ResultGORM, error) {
+func tryTestcase(ctx context.Context, submits types.SubmitsGORM, problem types.ProblemsGORM, langConfig langconf.LanguageConfig, timeLimit int, memoryLimit int, container dkrlib.Sandbox, judgeBox dkrlib.Sandbox) (types.ResultGORM, error) {
 	var (
 		testcases []types.TestcaseGORM
-		problem   types.ProblemsGORM
 		result    types.ResultGORM
 	)
 
@@ -180,94 +332,158 @@ func tryTestcase(ctx context.Context, submits types.SubmitsGORM, langConfig lang
 	}
 	defer db.Close()
 
-	db.
-		Table("problems").
-		Where("id = ? AND deleted_at IS NULL", submits.ProblemID).
-		First(&problem)
-
-	db.
+	if err := db.
 		Table("testcases").
 		Where("problem_id=? AND deleted_at IS NULL", submits.ProblemID).
-		Find(&testcases)
+		Find(&testcases).
+		Error; err != nil {
+		return types.ResultGORM{}, err
+	}
 
 	if len(testcases) == 0 {
 		return types.ResultGORM{}, errors.New("testcases not found")
 	}
 
 	if submits.Status == "WR" {
-		db.
+		if err := db.
 			Table("testcase_results").
 			Where("submit_id = ? AND deleted_at IS NULL", submits.ID).
-			Update("deleted_at", util.TimeToString(time.Now()))
+			Update("deleted_at", util.TimeToString(time.Now())).
+			Error; err != nil {
+			return types.ResultGORM{}, err
+		}
+	}
+
+	checker, err := newChecker(judgeBox, problem)
+	if err != nil {
+		return types.ResultGORM{}, err
+	}
+
+	files, err := newJudgeFiles()
+	if err != nil {
+		return types.ResultGORM{}, err
+	}
+	defer files.remove()
+
+	var answers *outputOnlyAnswers
+	if problem.ProblemType == "output_only" {
+		answers, err = loadOutputOnlyAnswers(ctx, container, files, len(testcases))
+		if err == errNotZip {
+			// 提出の形式の誤りなので、実行できなかった提出として理由を返す
+			return types.ResultGORM{Status: "CE", CompileError: err.Error()}, nil
+		}
+		if err != nil {
+			return types.ResultGORM{}, err
+		}
+		defer answers.close()
+	}
+
+	// 通常の問題では、実行時間とメモリをコンテナの申告ではなくホストで測る
+	metered := false
+	if problem.ProblemType != "interactive" && problem.ProblemType != "output_only" && strings.Contains(langConfig.ExecuteCmd, executeRedirect) {
+		if metered, err = canMeter(ctx, container); err != nil {
+			return types.ResultGORM{}, err
+		}
 	}
 
 	result.TestcaseResultsMap = make(map[int64]types.TestcaseResultsGORM)
 
 	for _, elem := range testcases {
+		if ctx.Err() != nil {
+			return types.ResultGORM{}, ctx.Err()
+		}
+
 		req := types.RequestJSON{
-			Mode:      "judge",
-			Cmd:       langConfig.ExecuteCmd,
-			SessionID: fmt.Sprintf("%d", submits.ID),
-			ProblemID: fmt.Sprintf("%d", submits.ProblemID),
-			Filename:  langConfig.FileName,
-			Testcase:  elem,
-			Problem:   problem,
-			TimeLimit: func() int {
-				if submits.Lang == "python38" {
-					return 6000
-				} else {
-					return 2000
-				}
-			}(),
+			Mode:        "judge",
+			Cmd:         langConfig.ExecuteCmd,
+			SessionID:   fmt.Sprintf("%d", submits.ID),
+			ProblemID:   fmt.Sprintf("%d", submits.ProblemID),
+			Filename:    langConfig.FileName,
+			Testcase:    elem,
+			Problem:     problem,
+			TimeLimit:   timeLimit,
+			MemoryLimit: memoryLimit,
 		}
+		if metered || problem.ProblemType == "interactive" || problem.ProblemType == "output_only" {
+			// コンテナにはテストケースの配置だけさせて、実行や出力の配置はホストから行う
+			req.Cmd = ":"
+		}
+
 		recv, err := cmdlib.RequestCmd(
+			ctx,
 			req,
-			containerIPAddress,
-			sessionIDChan,
+			container.Address(),
+			container.Token(),
 		)
 		if err != nil {
 			return types.ResultGORM{}, err
 		}
 
-		if recv.Timeout { // コンテナにリクエストが送れなかったとき
-			result.Status = "TLE"
-			db.
-				Table("submits").
-				Where("id = ? AND deleted_at IS NULL", submits.ID).
-				Update("status", result.Status)
-			for _, elem := range testcases {
-				testcaseResults := types.TestcaseResultsGORM{
-					SubmitID:      submits.ID,
-					TestcaseID:    elem.TestcaseID,
-					Status:        "TLE",
-					ExecutionTime: req.TimeLimit,
-					CreatedAt:     util.TimeToString(time.Now()),
-					UpdatedAt:     util.TimeToString(time.Now()),
-				}
-				db.
-					Table("testcase_results").
-					Create(&testcaseResults)
+		// コンテナクライアントが応答しないのは提出のせいとは限らないので、TLE にせず IE にしてコンテナを捨てる
+		if recv.Timeout {
+			return types.ResultGORM{}, fmt.Errorf("container did not respond to testcase %d", elem.TestcaseID)
+		}
+
+		// どの行に書くかはコンテナに選ばせず、ジャッジ側で埋める (gRPC のコンテナはそもそも返さない)
+		now := util.TimeToString(time.Now())
+		recv.TestcaseResults.SubmitID = submits.ID
+		recv.TestcaseResults.TestcaseID = elem.TestcaseID
+		recv.TestcaseResults.CreatedAt = now
+		recv.TestcaseResults.UpdatedAt = now
+
+		// 想定解をホストに読み出して、コンテナから消す。ホストで実行するとき (req.Cmd が ":") はユーザのプログラムを実行する前になる。
+		// コンテナクライアントが実行したときはもう実行し終わっているので、次のテストケースに想定解を残さないためだけに消す
+		if err := files.read(ctx, container, judgeBox != nil); err != nil {
+			return types.ResultGORM{}, err
+		}
+
+		switch {
+		case problem.ProblemType == "interactive":
+			recv.TestcaseResults, err = runInteractive(ctx, container, judgeBox, files, langConfig.ExecuteCmd, timeLimit, recv.TestcaseResults)
+		case problem.ProblemType == "output_only":
+			recv.TestcaseResults, err = checkOutputOnly(ctx, judgeBox, checker, answers, elem, files, recv.TestcaseResults)
+		case metered:
+			recv.TestcaseResults, err = executeSubmission(ctx, container, langConfig.ExecuteCmd, timeLimit, files, recv.TestcaseResults)
+			if err == nil {
+				recv.TestcaseResults, err = check(ctx, judgeBox, checker, files, recv.TestcaseResults)
+			}
+		default:
+			// コンテナクライアントが実行したので、出力はコンテナから読み出す
+			if recv.TestcaseResults.Status == "AC" || recv.TestcaseResults.Status == "WA" {
+				err = files.readUserOutput(ctx, container, recv.StdoutSize)
 			}
-			break
+			if err == nil {
+				recv.TestcaseResults, err = check(ctx, judgeBox, checker, files, recv.TestcaseResults)
+			}
+		}
+		if err != nil {
+			return types.ResultGORM{}, err
 		}
+		recv.TestcaseResults = applyLimits(recv.TestcaseResults, timeLimit, memoryLimit)
 
 		if priorityMap[result.Status] < priorityMap[recv.TestcaseResults.Status] {
 			result.Status = recv.TestcaseResults.Status
 
 			if result.Status != "AC" {
-				db.
+				if err := db.
 					Table("submits").
 					Where("id = ? AND deleted_at IS NULL", submits.ID).
-					Update("status", result.Status)
+					Update("status", result.Status).
+					Error; err != nil {
+					return types.ResultGORM{}, err
+				}
 			}
 		}
 
 		fmt.Println("Testcase Result: ", recv.TestcaseResults)
 
-		// testcase_results の挿入
-		db.
+		// testcase_results の挿入。カラムがなければ migrations を当てていないので IE にする
+		if err := db.
 			Table("testcase_results").
-			Create(&recv.TestcaseResults)
+			Create(&recv.TestcaseResults).
+			Error; err != nil {
+			return types.ResultGORM{}, err
+		}
 
 		result.TestcaseResultsMap[recv.TestcaseResults.TestcaseID] = recv.TestcaseResults
 	}
@@ -0,0 +1,141 @@
+package judgelib
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/checklib"
+	"github.com/cafecoder-dev/cafecoder-judge/src/dkrlib"
+	"github.com/cafecoder-dev/cafecoder-judge/src/langconf"
+	"github.com/cafecoder-dev/cafecoder-judge/src/types"
+)
+
+// 出力のみの問題で使う言語設定。提出はコンパイルも実行もせず、この名前でコンテナにダウンロードする
+var outputOnlyLangConfig = langconf.LanguageConfig{
+	FileName:            "submission",
+	TimeLimitMultiplier: 1,
+}
+
+// 出力のみの問題の提出の大きさの上限 (バイト)。超えたらすべてのテストケースを OLE にする
+const outputOnlySubmissionLimit = 256 * 1024 * 1024
+
+// errNotZip ... テストケースが複数ある出力のみの問題に、zip でない提出があった
+var errNotZip = errors.New("submission must be a zip archive containing one output file per testcase (e.g. 01.txt for testcase 01)")
+
+// 出力のみの問題の提出。ホストに読み出したものを、zip ならテストケースごとの出力として、そうでなければ 1 つの出力そのものとして使う
+type outputOnlyAnswers struct {
+	single   string               // zip でないとき、ホストに読み出した提出のパス
+	archive  *zip.ReadCloser      // zip のとき、開いた提出
+	files    map[string]*zip.File // 拡張子を除いたファイル名 -> ファイル
+	tooLarge bool                 // 提出が outputOnlySubmissionLimit を超えている
+}
+
+// loadOutputOnlyAnswers ... コンテナにダウンロードした提出を files の一時ディレクトリに読み出して開く。使い終わったら close すること。
+// zip でない提出は、テストケースが 1 つの問題でだけ受け付ける。それ以外では errNotZip を返す
+func loadOutputOnlyAnswers(ctx context.Context, container dkrlib.Sandbox, files *judgeFiles, testcaseCount int) (*outputOnlyAnswers, error) {
+	_, err := files.copyOut(ctx, container, outputOnlyLangConfig.FileName, outputOnlySubmissionLimit)
+	if err == dkrlib.ErrSizeLimit {
+		return &outputOnlyAnswers{tooLarge: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	submissionPath := files.path(outputOnlyLangConfig.FileName)
+	archive, err := zip.OpenReader(submissionPath)
+	if err != nil {
+		if testcaseCount != 1 {
+			return nil, errNotZip
+		}
+		return &outputOnlyAnswers{single: submissionPath}, nil
+	}
+
+	answers := &outputOnlyAnswers{archive: archive, files: make(map[string]*zip.File)}
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		answers.files[trimExt(path.Base(file.Name))] = file
+	}
+
+	return answers, nil
+}
+
+func (answers *outputOnlyAnswers) close() {
+	if answers.archive != nil {
+		answers.archive.Close()
+	}
+}
+
+func trimExt(name string) string {
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// testcase に対する出力を開く。見つからなければ ok は false。
+// 出力が outputLimit を超えているとわかっていれば、開かずにその大きさだけを返す
+func (answers *outputOnlyAnswers) open(testcase types.TestcaseGORM) (reader io.ReadCloser, size int64, ok bool, err error) {
+	if answers.tooLarge {
+		return nil, outputLimit + 1, true, nil
+	}
+	if answers.single != "" {
+		reader, err = os.Open(answers.single)
+		return reader, 0, err == nil, err
+	}
+
+	file, exist := answers.files[trimExt(testcase.Name)]
+	if !exist {
+		return nil, 0, false, nil
+	}
+
+	size = int64(file.UncompressedSize64)
+	if size > outputLimit {
+		return nil, size, true, nil
+	}
+
+	reader, err = file.Open()
+	return reader, size, err == nil, err
+}
+
+// checkOutputOnly ... 提出に含まれる testcase の出力を、ユーザのプログラムの出力としてホストの files に書き出し、チェッカーで判定する
+func checkOutputOnly(ctx context.Context, judgeBox dkrlib.Sandbox, checker checklib.Checker, answers *outputOnlyAnswers, testcase types.TestcaseGORM, files *judgeFiles, testcaseResults types.TestcaseResultsGORM) (types.TestcaseResultsGORM, error) {
+	// 実行していないので、コンテナが計測した時間とメモリは使わない
+	testcaseResults.ExecutionTime = 0
+	testcaseResults.ExecutionMemory = 0
+
+	reader, size, ok, err := answers.open(testcase)
+	if err != nil {
+		return testcaseResults, err
+	}
+	if !ok {
+		return applyCheckResult(testcaseResults, checklib.Result{Status: "WA", Message: "output for " + testcase.Name + " not found"}), nil
+	}
+	if size > outputLimit {
+		return applyCheckResult(testcaseResults, checklib.Result{Status: "OLE"}), nil
+	}
+	defer reader.Close()
+
+	output, err := os.Create(files.path(userOutputPath))
+	if err != nil {
+		return testcaseResults, err
+	}
+	defer output.Close()
+
+	// zip の申告する大きさは信用せず、outputLimit を超えたところで書くのをやめる
+	written, err := io.Copy(output, io.LimitReader(reader, outputLimit+1))
+	if err != nil {
+		return testcaseResults, err
+	}
+	if err := output.Close(); err != nil {
+		return testcaseResults, err
+	}
+	files.outputSize = written
+
+	// check は正常に実行が終わったものだけを判定するので、ここでは実行できたことにする
+	testcaseResults.Status = "AC"
+	return check(ctx, judgeBox, checker, files, testcaseResults)
+}
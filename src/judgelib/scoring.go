@@ -46,20 +46,23 @@ func scoring(submits types.SubmitsGORM, result types.ResultGORM) int64 {
 			append(testcaseSetMap[testcaseTestcaseSet.TestcaseSetID], testcaseTestcaseSet.TestcaseID)
 	}
 
+	// テストケースセットの得点は、含まれるテストケースの得点率の最小値をかけたもの。
+	// AC なら 1、それ以外はチェッカーが返した部分点 (なければ 0)
 	score := int64(0)
 	for _, testcaseSet := range testcaseSets {
-		isAC := true
+		rate := 1.0
 
 		for _, testcaseID := range testcaseSetMap[testcaseSet.ID] {
-			if result.TestcaseResultsMap[testcaseID].Status != "AC" {
-				isAC = false
-				break
+			testcaseResult := result.TestcaseResultsMap[testcaseID]
+			if testcaseResult.Status == "AC" {
+				continue
+			}
+			if testcaseResult.Score < rate {
+				rate = testcaseResult.Score
 			}
 		}
 
-		if isAC {
-			score += int64(testcaseSet.Points)
-		}
+		score += int64(float64(testcaseSet.Points) * rate)
 	}
 
 	return score
@@ -1,127 +1,252 @@
 package langconf
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/types"
 )
 
+// ConfigPath ... 言語設定ファイルのパス
+const ConfigPath = "language_configs.json"
+
 type LanguageConfig struct {
 	FileName   string
 	CompileCmd string
 	ExecuteCmd string
+
+	TimeLimitMultiplier float64
+	TimeLimitOffset     int // ms
+	MemoryLimitOffset   int // MiB
+	MemoryLimit         int // MiB. MemLimit の上限。0 なら上限なし
+
+	Image       string // 空なら既定のイメージ
+	ImageTag    string
+	ImageDigest string
+}
+
+// ImageRef ... この言語で使うイメージを "name:tag@digest" の形式で返す。イメージの指定がなければ defaultImage
+func (langConfig LanguageConfig) ImageRef(defaultImage string) string {
+	if langConfig.Image == "" {
+		return defaultImage
+	}
+
+	ref := langConfig.Image
+	if langConfig.ImageTag != "" {
+		ref += ":" + langConfig.ImageTag
+	}
+	if langConfig.ImageDigest != "" {
+		ref += "@" + langConfig.ImageDigest
+	}
+
+	return ref
+}
+
+// TimeLimit ... 問題の実行時間制限 (ms) にこの言語の倍率と加算分を適用する
+func (langConfig LanguageConfig) TimeLimit(problemTimeLimit int) int {
+	return int(float64(problemTimeLimit)*langConfig.TimeLimitMultiplier) + langConfig.TimeLimitOffset
+}
+
+// MemLimit ... 問題のメモリ制限 (MiB) にこの言語の加算分を適用し、言語の上限があればそれで抑える
+func (langConfig LanguageConfig) MemLimit(problemMemoryLimit int) int {
+	memoryLimit := problemMemoryLimit + langConfig.MemoryLimitOffset
+	if langConfig.MemoryLimit > 0 && memoryLimit > langConfig.MemoryLimit {
+		return langConfig.MemoryLimit
+	}
+	return memoryLimit
+}
+
+var (
+	mu              sync.RWMutex
+	languageConfigs map[string]LanguageConfig
+	unavailable     map[string]error // イメージが使えない言語 -> 理由
+)
+
+// Load ... 言語設定ファイルを読み込み、検証してから以降の LangConfig で使えるようにする
+func Load(path string) error {
+	configs, err := readConfigs(path)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	languageConfigs = configs
+	mu.Unlock()
+
+	return nil
+}
+
+// Diff ... Reload で追加・変更・削除された言語 ID
+type Diff struct {
+	Added   []string
+	Changed []string
+	Removed []string
+}
+
+// Reload ... 言語設定ファイルを読み直して差し替える。
+// 検証に失敗した場合は現在の設定をそのまま使い続ける。
+// 差し替え前に LangConfig で取得した設定は値のコピーなので、ジャッジ中の提出には影響しない。
+func Reload(path string) (Diff, error) {
+	configs, err := readConfigs(path)
+	if err != nil {
+		return Diff{}, err
+	}
+
+	mu.Lock()
+	diff := diffConfigs(languageConfigs, configs)
+	languageConfigs = configs
+	mu.Unlock()
+
+	return diff, nil
 }
 
-// todo json 化
+// LangConfig ... Load で読み込んだ設定から langID の言語設定を返す
 func LangConfig(langID string) (LanguageConfig, error) {
-	/*
-		var languageConfigs []types.LanguageConfigJSON
-		bytes, err := ioutil.ReadFile("language_configs.json")
-		if err != nil {
-			return LanguageConfig{}, err
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if languageConfigs == nil {
+		return LanguageConfig{}, errors.New("language configs are not loaded")
+	}
+
+	langConfig, ok := languageConfigs[langID]
+	if !ok {
+		return LanguageConfig{}, errors.New("undefined language")
+	}
+
+	return langConfig, nil
+}
+
+// CheckImages ... 各言語のイメージを ensure で用意し、用意できなかった言語とその理由を返す。
+// 結果は Available に反映され、次に CheckImages を呼ぶまで変わらない
+func CheckImages(defaultImage string, ensure func(image string) error) map[string]error {
+	mu.RLock()
+	images := make(map[string][]string)
+	for langID, langConfig := range languageConfigs {
+		ref := langConfig.ImageRef(defaultImage)
+		images[ref] = append(images[ref], langID)
+	}
+	mu.RUnlock()
+
+	failed := make(map[string]error)
+	for image, langIDs := range images {
+		if err := ensure(image); err != nil {
+			for _, langID := range langIDs {
+				failed[langID] = fmt.Errorf("image %s: %w", image, err)
+			}
+		}
+	}
+
+	mu.Lock()
+	unavailable = failed
+	mu.Unlock()
+
+	return failed
+}
+
+// Available ... langID の言語のイメージが使えなければその理由を返す
+func Available(langID string) error {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return unavailable[langID]
+}
+
+func readConfigs(path string) (map[string]LanguageConfig, error) {
+	var configJSON []types.LanguageConfigJSON
+
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(bytes, &configJSON); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	configs := make(map[string]LanguageConfig, len(configJSON))
+	for i, elem := range configJSON {
+		if err := validate(elem); err != nil {
+			return nil, fmt.Errorf("%s: entry %d: %w", path, i, err)
+		}
+		if _, exist := configs[elem.Name]; exist {
+			return nil, fmt.Errorf("%s: entry %d: duplicate language %q", path, i, elem.Name)
 		}
 
-		if err := json.Unmarshal(bytes, &languageConfigs); err != nil {
-			return LanguageConfig{}, err
+		if elem.TimeLimitMultiplier == 0 {
+			elem.TimeLimitMultiplier = 1
 		}
 
-		for _, langConf := range languageConfigs {
-			if langConf.Name == langID {
-				return LanguageConfig{
-					FileName:   langConf.Name,
-					CompileCmd: langConf.CompileCmd,
-					ExecuteCmd: langConf.ExecuteCmd,
-				}, nil
-			}
+		configs[elem.Name] = LanguageConfig{
+			FileName:            elem.Filename,
+			CompileCmd:          elem.CompileCmd,
+			ExecuteCmd:          elem.ExecuteCmd,
+			TimeLimitMultiplier: elem.TimeLimitMultiplier,
+			TimeLimitOffset:     elem.TimeLimitOffset,
+			MemoryLimitOffset:   elem.MemoryLimitOffset,
+			MemoryLimit:         elem.MemoryLimit,
+			Image:               elem.Image,
+			ImageTag:            elem.ImageTag,
+			ImageDigest:         elem.ImageDigest,
 		}
+	}
 
-		return LanguageConfig{}, errors.New("undefine language")
-	*/
-
-	langConfig := LanguageConfig{}
-
-	switch langID {
-	case "c17_gcc:10.2.0": //C17
-		langConfig.CompileCmd = "gcc-10 Main.c -O2 -lm -std=gnu17 -o Main.out 2> userStderr.txt"
-		langConfig.ExecuteCmd = "./Main.out < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.c"
-	case "cpp17_gcc:10.2.0": //C++17
-		langConfig.CompileCmd = "g++-10 Main.cpp -O2 -lm -std=gnu++17 -o Main.out 2> userStderr.txt"
-		langConfig.ExecuteCmd = "./Main.out < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.cpp"
-	case "cpp17-acl_gcc:10.2.0": //C++17 + ACL
-		langConfig.CompileCmd = "g++-10 Main.cpp -O2 -lm -std=gnu++17 -I . -o Main.out 2> userStderr.txt"
-		langConfig.ExecuteCmd = "./Main.out < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.cpp"
-	case "cpp20_gcc:10.2.0": //C++20
-		langConfig.CompileCmd = "g++-10 Main.cpp -O2 -lm -std=gnu++2a -o Main.out 2> userStderr.txt"
-		langConfig.ExecuteCmd = "./Main.out < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.cpp"
-	case "java:11.0.9": //java11
-		langConfig.CompileCmd = "javac -encoding UTF-8 Main.java 2> userStderr.txt"
-		langConfig.ExecuteCmd = "java Main < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.java"
-	case "python:3.9.0": //python3
-		langConfig.CompileCmd = "python3.9 -m py_compile Main.py 2> userStderr.txt"
-		langConfig.ExecuteCmd = "python3.9 Main.py < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.py"
-	case "pypy3:7.3.3": //pypy3
-		langConfig.CompileCmd = "pypy3 -m py_compile Main.py 2> userStderr.txt"
-		langConfig.ExecuteCmd = "pypy3 Main.py < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.py"
-	case "cs_mono:6.12.0.90": //C#
-		langConfig.CompileCmd = "source ~/.profile && mcs Main.cs -out:Main.exe 2> userStderr.txt"
-		langConfig.ExecuteCmd = "source ~/.profile && mono Main.exe < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.cs"
-	case "cs_dotnet:5.0": // C#
-		langConfig.CompileCmd = "source ~/.profile && cd Main && dotnet new console && mv ./../Main.cs Program.cs && dotnet publish -c Release --nologo -v q -o . 2> ../userStderr.txt && cd /"
-		langConfig.ExecuteCmd = "source ~/.profile && dotnet ./Main/Main.dll < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.cs"
-	case "go:1.15.5": //golang
-		langConfig.CompileCmd = "source ~/.profile && mv Main.go Main && cd Main && go build Main.go 2> ../userStderr.txt"
-		langConfig.ExecuteCmd = "./Main/Main < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.go"
-	case "nim:1.4.0":
-		langConfig.CompileCmd = "source ~/.profile && nim cpp -d:release --opt:speed --multimethods:on -o:Main.out Main.nim 2> userStderr.txt"
-		langConfig.ExecuteCmd = "./Main.out < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.nim"
-	case "rust:1.48.0":
-		langConfig.CompileCmd = "source ~/.profile && cd rust_workspace && mv /Main.rs ./src/main.rs && cargo build --release 2> /userStderr.txt && cd /"
-		langConfig.ExecuteCmd = "./rust_workspace/target/release/Rust < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.rs"
-	case "ruby:2.7.2":
-		langConfig.CompileCmd = "source ~/.profile && ruby -w -c ./Main.rb 2> userStderr.txt"
-		langConfig.ExecuteCmd = "source ~/.profile && ruby ./Main.rb < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.rb"
-	case "kotlin:1.4.10":
-		langConfig.CompileCmd = "source ~/.profile && kotlinc ./Main.kt -include-runtime -d Main.jar 2> userStderr.txt"
-		langConfig.ExecuteCmd = "source ~/.profile && kotlin Main.jar < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.kt"
-	case "fortran:10.2.0":
-		langConfig.CompileCmd = "gfortran-10 -O2 Main.f90 -o Main.out 2> userStderr.txt"
-		langConfig.ExecuteCmd = "./Main.out < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.f90"
-	case "perl:5.30.0":
-		langConfig.CompileCmd = "perl -c Main.pl 2> userStderr.txt"
-		langConfig.ExecuteCmd = "perl Main.pl < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.pl"
-	case "raku:2020.10":
-		langConfig.CompileCmd = "source ~/.profile && perl6 -c Main.p6 2> userStderr.txt"
-		langConfig.ExecuteCmd = "source ~/.profile && perl6 Main.p6 < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.p6"
-	case "crystal:0.35.1":
-		langConfig.CompileCmd = "crystal build Main.cr -o Main.out 2> userStderr.txt"
-		langConfig.ExecuteCmd = "./Main.out < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.cr"
-	case "text_cat:8.30":
-		langConfig.CompileCmd = ": 2> userStderr.txt"
-		langConfig.ExecuteCmd = "cat Main.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.txt"
-	case "bash:5.0.17":
-		langConfig.CompileCmd = "bash -n Main.sh 2> userStderr.txt"
-		langConfig.ExecuteCmd = "bash Main.sh < testcase.txt > userStdout.txt 2> userStderr.txt"
-		langConfig.FileName = "Main.sh"
-	default:
-		return langConfig, errors.New("undefined language")
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("%s: no languages defined", path)
 	}
 
-	return langConfig, nil
+	return configs, nil
+}
+
+func validate(elem types.LanguageConfigJSON) error {
+	switch {
+	case elem.Name == "":
+		return errors.New("name is empty")
+	case elem.CompileCmd == "":
+		return fmt.Errorf("%s: compile_cmd is empty", elem.Name)
+	case elem.ExecuteCmd == "":
+		return fmt.Errorf("%s: execute_cmd is empty", elem.Name)
+	case elem.Filename == "":
+		return fmt.Errorf("%s: filename is empty", elem.Name)
+	case elem.TimeLimitMultiplier < 0:
+		return fmt.Errorf("%s: time_limit_multiplier is negative", elem.Name)
+	case elem.TimeLimitOffset < 0:
+		return fmt.Errorf("%s: time_limit_offset is negative", elem.Name)
+	case elem.MemoryLimitOffset < 0:
+		return fmt.Errorf("%s: memory_limit_offset is negative", elem.Name)
+	case elem.MemoryLimit < 0:
+		return fmt.Errorf("%s: memory_limit is negative", elem.Name)
+	case elem.Image == "" && (elem.ImageTag != "" || elem.ImageDigest != ""):
+		return fmt.Errorf("%s: image_tag or image_digest is given without image", elem.Name)
+	}
+
+	return nil
+}
+
+func diffConfigs(before, after map[string]LanguageConfig) Diff {
+	var diff Diff
+
+	for langID, afterConfig := range after {
+		beforeConfig, exist := before[langID]
+		if !exist {
+			diff.Added = append(diff.Added, langID)
+		} else if beforeConfig != afterConfig {
+			diff.Changed = append(diff.Changed, langID)
+		}
+	}
+	for langID := range before {
+		if _, exist := after[langID]; !exist {
+			diff.Removed = append(diff.Removed, langID)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Changed)
+	sort.Strings(diff.Removed)
+
+	return diff
 }
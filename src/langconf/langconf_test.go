@@ -0,0 +1,157 @@
+package langconf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cafecoder-dev/cafecoder-judge/src/types"
+)
+
+func TestValidate(t *testing.T) {
+	valid := types.LanguageConfigJSON{Name: "cpp", CompileCmd: "g++ Main.cpp", ExecuteCmd: "./a.out", Filename: "Main.cpp"}
+
+	tests := []struct {
+		name    string
+		modify  func(elem *types.LanguageConfigJSON)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(elem *types.LanguageConfigJSON) {}},
+		{name: "limits", modify: func(elem *types.LanguageConfigJSON) {
+			elem.TimeLimitMultiplier, elem.TimeLimitOffset, elem.MemoryLimit = 2, 100, 512
+		}},
+		{name: "image", modify: func(elem *types.LanguageConfigJSON) {
+			elem.Image, elem.ImageTag, elem.ImageDigest = "cafecoder-cpp", "1.0", "sha256:abc"
+		}},
+		{name: "empty name", modify: func(elem *types.LanguageConfigJSON) { elem.Name = "" }, wantErr: true},
+		{name: "empty compile_cmd", modify: func(elem *types.LanguageConfigJSON) { elem.CompileCmd = "" }, wantErr: true},
+		{name: "empty execute_cmd", modify: func(elem *types.LanguageConfigJSON) { elem.ExecuteCmd = "" }, wantErr: true},
+		{name: "empty filename", modify: func(elem *types.LanguageConfigJSON) { elem.Filename = "" }, wantErr: true},
+		{name: "negative multiplier", modify: func(elem *types.LanguageConfigJSON) { elem.TimeLimitMultiplier = -1 }, wantErr: true},
+		{name: "negative offset", modify: func(elem *types.LanguageConfigJSON) { elem.TimeLimitOffset = -1 }, wantErr: true},
+		{name: "negative memory limit offset", modify: func(elem *types.LanguageConfigJSON) { elem.MemoryLimitOffset = -1 }, wantErr: true},
+		{name: "negative memory limit", modify: func(elem *types.LanguageConfigJSON) { elem.MemoryLimit = -1 }, wantErr: true},
+		{name: "tag without image", modify: func(elem *types.LanguageConfigJSON) { elem.ImageTag = "1.0" }, wantErr: true},
+		{name: "digest without image", modify: func(elem *types.LanguageConfigJSON) { elem.ImageDigest = "sha256:abc" }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			elem := valid
+			tt.modify(&elem)
+
+			err := validate(elem)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadConfigs(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]LanguageConfig
+		wantErr bool
+	}{
+		{
+			name:    "default multiplier",
+			content: `[{"name": "cpp", "compile_cmd": "g++ Main.cpp", "execute_cmd": "./a.out", "filename": "Main.cpp"}]`,
+			want:    map[string]LanguageConfig{"cpp": {FileName: "Main.cpp", CompileCmd: "g++ Main.cpp", ExecuteCmd: "./a.out", TimeLimitMultiplier: 1}},
+		},
+		{
+			name:    "limits",
+			content: `[{"name": "py", "compile_cmd": ":", "execute_cmd": "python3 Main.py", "filename": "Main.py", "time_limit_multiplier": 3, "time_limit_offset": 200, "memory_limit_offset": 64, "memory_limit": 1024}]`,
+			want:    map[string]LanguageConfig{"py": {FileName: "Main.py", CompileCmd: ":", ExecuteCmd: "python3 Main.py", TimeLimitMultiplier: 3, TimeLimitOffset: 200, MemoryLimitOffset: 64, MemoryLimit: 1024}},
+		},
+		{name: "invalid json", content: `[{"name": "cpp",`, wantErr: true},
+		{name: "no languages", content: `[]`, wantErr: true},
+		{name: "invalid entry", content: `[{"name": "cpp"}]`, wantErr: true},
+		{
+			name: "duplicate language",
+			content: `[{"name": "cpp", "compile_cmd": "g++ Main.cpp", "execute_cmd": "./a.out", "filename": "Main.cpp"},
+				{"name": "cpp", "compile_cmd": "clang++ Main.cpp", "execute_cmd": "./a.out", "filename": "Main.cpp"}]`,
+			wantErr: true,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "langconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, fmt.Sprintf("%d.json", i))
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readConfigs(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readConfigs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("readConfigs() = %v, want %v", got, tt.want)
+			}
+			for name, want := range tt.want {
+				if got[name] != want {
+					t.Errorf("readConfigs()[%q] = %+v, want %+v", name, got[name], want)
+				}
+			}
+		})
+	}
+
+	if _, err := readConfigs(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("readConfigs() of a missing file error = nil, want error")
+	}
+}
+
+func TestTimeLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		langConfig LanguageConfig
+		problem    int
+		want       int
+	}{
+		{name: "no change", langConfig: LanguageConfig{TimeLimitMultiplier: 1}, problem: 2000, want: 2000},
+		{name: "multiplier", langConfig: LanguageConfig{TimeLimitMultiplier: 1.5}, problem: 2000, want: 3000},
+		{name: "offset", langConfig: LanguageConfig{TimeLimitMultiplier: 1, TimeLimitOffset: 500}, problem: 2000, want: 2500},
+		{name: "both", langConfig: LanguageConfig{TimeLimitMultiplier: 2, TimeLimitOffset: 100}, problem: 1000, want: 2100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.langConfig.TimeLimit(tt.problem); got != tt.want {
+				t.Errorf("TimeLimit(%d) = %d, want %d", tt.problem, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		langConfig LanguageConfig
+		problem    int
+		want       int
+	}{
+		{name: "no change", langConfig: LanguageConfig{}, problem: 256, want: 256},
+		{name: "offset", langConfig: LanguageConfig{MemoryLimitOffset: 64}, problem: 256, want: 320},
+		{name: "under cap", langConfig: LanguageConfig{MemoryLimitOffset: 64, MemoryLimit: 1024}, problem: 256, want: 320},
+		{name: "capped", langConfig: LanguageConfig{MemoryLimitOffset: 64, MemoryLimit: 1024}, problem: 1024, want: 1024},
+		{name: "cap without offset", langConfig: LanguageConfig{MemoryLimit: 512}, problem: 1024, want: 512},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.langConfig.MemLimit(tt.problem); got != tt.want {
+				t.Errorf("MemLimit(%d) = %d, want %d", tt.problem, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,28 +1,45 @@
 package types
 
 type ProblemsGORM struct {
-	ProblemId int64  `gorm:"column:id"`
-	UUID      string `gorm:"column:uuid"`
+	ProblemId          int64  `gorm:"column:id"`
+	UUID               string `gorm:"column:uuid"`
+	ExecutionTimeLimit int    `gorm:"column:execution_time_limit"` // ms. 0 なら既定値
+	MemoryLimit        int    `gorm:"column:memory_limit"`         // MiB. 0 なら既定値
+
+	Checker       string  `gorm:"column:checker"`        // checklib に登録されたチェッカーの種類。"" なら "whitespace"
+	AbsoluteError float64 `gorm:"column:absolute_error"` // checker が "float" のときの許容絶対誤差
+	RelativeError float64 `gorm:"column:relative_error"` // checker が "float" のときの許容相対誤差
+	CheckerPath   string  `gorm:"column:checker_path"`   // checker が "custom" のときのチェッカーのソース (testlib.h 準拠の C++)
+
+	ProblemType    string `gorm:"column:problem_type"`    // "" なら通常の問題, "interactive" ならインタラクティブ問題, "output_only" なら出力のみの問題
+	InteractorPath string `gorm:"column:interactor_path"` // インタラクティブ問題のインタラクタのソース (testlib.h 準拠の C++)
 }
 
 type ResultGORM struct {
-	Status             string `gorm:"column:status"`
-	ExecutionTime      int    `gorm:"column:execution_time"`
-	ExecutionMemory    int    `gorm:"column:execution_memory"`
-	Point              int    `gorm:"column:point"` // int64 にしたほうがいいかもしれない(カラムにあわせて int にした)
-	CompileError       string `gorm:"column:compile_error"`
-	
+	Status          string `gorm:"column:status"`
+	ExecutionTime   int    `gorm:"column:execution_time"`
+	ExecutionMemory int    `gorm:"column:execution_memory"`
+	Point           int    `gorm:"column:point"` // int64 にしたほうがいいかもしれない(カラムにあわせて int にした)
+	CompileError    string `gorm:"column:compile_error"`
+
 	TestcaseResultsMap map[int64]TestcaseResultsGORM
 }
 
 type TestcaseResultsGORM struct {
-	SubmitID        int64  `gorm:"column:submit_id" json:"submit_id"`
-	TestcaseID      int64  `gorm:"column:testcase_id" json:"testcase_id"`
-	Status          string `gorm:"column:status" json:"status"`
-	ExecutionTime   int    `gorm:"column:execution_time" json:"execution_time"`
-	ExecutionMemory int    `gorm:"column:execution_memory" json:"execution_memory"`
-	CreatedAt       string `gorm:"column:created_at" json:"created_at"`
-	UpdatedAt       string `gorm:"column:updated_at" json:"updated_at"`
+	SubmitID        int64   `gorm:"column:submit_id" json:"submit_id"`
+	TestcaseID      int64   `gorm:"column:testcase_id" json:"testcase_id"`
+	Status          string  `gorm:"column:status" json:"status"`
+	ExecutionTime   int     `gorm:"column:execution_time" json:"execution_time"`
+	ExecutionMemory int     `gorm:"column:execution_memory" json:"execution_memory"`
+	Score           float64 `gorm:"column:score" json:"score"`                     // チェッカーが返した部分点 (0 〜 1)
+	CheckerMessage  string  `gorm:"column:checker_message" json:"checker_message"` // チェッカーのメッセージ
+	// WA のとき、最初に食い違った箇所 (行・行内のトークンの番号と、想定解・ユーザの出力の該当部分)
+	MismatchLine     int    `gorm:"column:mismatch_line" json:"mismatch_line"`
+	MismatchToken    int    `gorm:"column:mismatch_token" json:"mismatch_token"`
+	MismatchExpected string `gorm:"column:mismatch_expected" json:"mismatch_expected"`
+	MismatchActual   string `gorm:"column:mismatch_actual" json:"mismatch_actual"`
+	CreatedAt        string `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt        string `gorm:"column:updated_at" json:"updated_at"`
 }
 
 type TestcaseGORM struct {
@@ -36,6 +53,7 @@ type SubmitsGORM struct {
 	ProblemID int64  `gorm:"column:problem_id"`
 	Path      string `gorm:"column:path"`
 	Lang      string `gorm:"column:lang"`
+	UpdatedAt string `gorm:"column:updated_at"`
 }
 
 type TestcaseSetsGORM struct {
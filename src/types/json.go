@@ -1,5 +1,41 @@
 package types
 
+import "encoding/json"
+
+// MessageJSON ... ジャッジとコンテナの間でやりとりするメッセージ。長さ付きのフレームに 1 つずつ入れて送る。
+// Signature はコンテナごとのトークンを鍵にした Type と Nonce と Payload の HMAC-SHA256 (hex)。
+// Nonce は要求ごとにジャッジが決める乱数で、応答には答える要求の Nonce をそのまま入れる
+type MessageJSON struct {
+	Type      string          `json:"type"` // "hello", "download", "compile", "judge", "ping", "cancel", "rekey", "result", "pong", "rekeyed", "error"
+	Nonce     string          `json:"nonce"`
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"signature"`
+}
+
+// HelloJSON ... 接続してすぐに交換するメッセージ。
+// ジャッジは対応するバージョンと機能をすべて送り、コンテナは選んだバージョンと両方が対応する機能を返す
+type HelloJSON struct {
+	Versions     []int    `json:"versions,omitempty"`
+	Version      int      `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// ErrorJSON ... 要求を処理できなかったときの応答
+type ErrorJSON struct {
+	Code    string `json:"code"` // "unsupported_version", "unknown_type", "bad_request", "canceled", "internal"
+	Message string `json:"message"`
+}
+
+// CancelJSON ... 実行中の要求の取り消し
+type CancelJSON struct {
+	SessionID string `json:"sessionID"`
+}
+
+// RekeyJSON ... 以降の署名に使うトークンの変更。コンテナは新しいトークンで署名した "rekeyed" を返す
+type RekeyJSON struct {
+	Token string `json:"token"`
+}
+
 type CmdResultJSON struct {
 	SessionID  string `json:"sessionID"`
 	Time       int    `json:"time"`
@@ -17,15 +53,16 @@ type CmdResultJSON struct {
 }
 
 type RequestJSON struct {
-	Mode      string       `json:"mode"` //Mode ... "judge" or "compile" or "download"
-	SessionID string       `json:"sessionID"`
-	Cmd       string       `json:"cmd"`
-	CodePath  string       `json:"codePath"`
-	Filename  string       `json:"filename"`
-	ProblemID string       `json:"problemID"`
-	TimeLimit int          `json:"timeLimit"`
-	Testcase  TestcaseGORM `json:"testcase"`
-	Problem   ProblemsGORM `json:"problem"`
+	Mode        string       `json:"mode"` //Mode ... "judge" or "compile" or "download"
+	SessionID   string       `json:"sessionID"`
+	Cmd         string       `json:"cmd"`
+	CodePath    string       `json:"codePath"`
+	Filename    string       `json:"filename"`
+	ProblemID   string       `json:"problemID"`
+	TimeLimit   int          `json:"timeLimit"`   // ms
+	MemoryLimit int          `json:"memoryLimit"` // MiB
+	Testcase    TestcaseGORM `json:"testcase"`
+	Problem     ProblemsGORM `json:"problem"`
 }
 
 type LanguageConfigJSON struct {
@@ -33,4 +70,13 @@ type LanguageConfigJSON struct {
 	CompileCmd string `json:"compile_cmd"`
 	ExecuteCmd string `json:"execute_cmd"`
 	Filename   string `json:"filename"`
-}
\ No newline at end of file
+
+	TimeLimitMultiplier float64 `json:"time_limit_multiplier"` // 省略時は 1
+	TimeLimitOffset     int     `json:"time_limit_offset"`     // ms
+	MemoryLimitOffset   int     `json:"memory_limit_offset"`   // MiB. 問題のメモリ制限に足す
+	MemoryLimit         int     `json:"memory_limit"`          // MiB. 加算後のメモリ制限の上限。省略時は上限なし
+
+	Image       string `json:"image"`        // 省略時は既定のイメージ
+	ImageTag    string `json:"image_tag"`    // 省略時は latest
+	ImageDigest string `json:"image_digest"` // "sha256:..."。指定すると中身が一致するイメージしか使わない
+}
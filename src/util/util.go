@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"math/big"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/cafecoder-dev/cafecoder-judge/src/types"
@@ -50,3 +51,35 @@ func GenRandomString(digit int) string {
 
 	return s
 }
+
+// SanitizeString ... DB の charset=utf8 (1 文字 3 バイトまで) に保存できるように、不正な UTF-8 を U+FFFD に、
+// U+FFFF を超える文字を \U0001F600 のような表記に置き換える
+func SanitizeString(str string) string {
+	str = strings.ToValidUTF8(str, "\uFFFD")
+
+	var builder strings.Builder
+	for _, r := range str {
+		if r > 0xFFFF {
+			fmt.Fprintf(&builder, "\\U%08X", r)
+			continue
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
+// TruncateString ... マルチバイト文字の途中で切らないように、先頭 limit バイト以内に切り詰める
+func TruncateString(str string, limit int) string {
+	if len(str) <= limit {
+		return str
+	}
+
+	cut := 0
+	for i := range str {
+		if i > limit {
+			break
+		}
+		cut = i
+	}
+	return str[:cut]
+}
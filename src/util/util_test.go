@@ -0,0 +1,60 @@
+package util
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeString(t *testing.T) {
+	tests := []struct {
+		name string
+		str  string
+		want string
+	}{
+		{name: "ascii", str: "1 2\n3", want: "1 2\n3"},
+		{name: "three bytes", str: "こんにちは", want: "こんにちは"},
+		{name: "invalid utf-8", str: "a\xff\xfeb", want: "a�b"},
+		{name: "cut in the middle of a character", str: "あ\xe3\x81", want: "あ�"},
+		{name: "four bytes", str: "a😀b", want: `a\U0001F600b`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SanitizeString(tt.str)
+			if got != tt.want {
+				t.Errorf("SanitizeString(%q) = %q, want %q", tt.str, got, tt.want)
+			}
+			for _, r := range got {
+				if utf8.RuneLen(r) > 3 {
+					t.Errorf("SanitizeString(%q) = %q contains %U", tt.str, got, r)
+				}
+			}
+		})
+	}
+}
+
+func TestTruncateString(t *testing.T) {
+	tests := []struct {
+		name  string
+		str   string
+		limit int
+		want  string
+	}{
+		{name: "short", str: "abc", limit: 5, want: "abc"},
+		{name: "ascii", str: "abcdef", limit: 3, want: "abc"},
+		{name: "multibyte boundary", str: "ああ", limit: 4, want: "あ"},
+		{name: "sanitized", str: SanitizeString("a\xff😀"), limit: 4, want: "a�"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := TruncateString(tt.str, tt.limit)
+			if got != tt.want {
+				t.Errorf("TruncateString(%q, %d) = %q, want %q", tt.str, tt.limit, got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("TruncateString(%q, %d) = %q is not valid UTF-8", tt.str, tt.limit, got)
+			}
+		})
+	}
+}